@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/simonfxr/nix-download/narextract"
+)
+
+// narInfoFieldOrder is the order in which Nix writes narinfo fields.
+var narInfoFieldOrder = []string{
+	"StorePath", "URL", "Compression", "FileHash", "FileSize",
+	"NarHash", "NarSize", "References", "Deriver", "System",
+}
+
+// initBinaryCacheDir makes dir a file:// binary cache for -download-only.
+func initBinaryCacheDir(dir string) error {
+	if err := os.MkdirAll(filepath.Join(dir, "nar"), 0755); err != nil {
+		return err
+	}
+	infoPath := filepath.Join(dir, "nix-cache-info")
+	if _, err := os.Stat(infoPath); err == nil {
+		return nil
+	}
+	return os.WriteFile(infoPath, []byte("StoreDir: "+storeDir+"\n"), 0644)
+}
+
+func compressionExtension(compression string) (string, error) {
+	switch compression {
+	case "none":
+		return "", nil
+	case "gzip":
+		return ".gz", nil
+	case "xz":
+		return ".xz", nil
+	case "zstd":
+		return ".zst", nil
+	default:
+		return "", fmt.Errorf("unsupported compression type: %s", compression)
+	}
+}
+
+// downloadNar stores the compressed NAR of sp and its narinfo in the
+// -download-only binary cache without extracting it. Both the FileHash of
+// the compressed NAR and the NarHash of its contents are verified.
+func (d *Downloader) downloadNar(sp StorePath) error {
+	if sp.Compression != "unknown" {
+		if _, err := compressionExtension(sp.Compression); err != nil {
+			return err
+		}
+	}
+
+	if offline && !isLocalURL(sp.NarURL) {
+		return fmt.Errorf("offline: NAR %s requires a network fetch", sp.NarURL)
+	}
+
+	release, err := acquireNarMemory(sp)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	resp, err := httpGet(d.NarClient, sp.NarURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch NAR: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &httpStatusError{"NAR", resp.Status}
+	}
+
+	narDir := filepath.Join(downloadOnlyDir, "nar")
+	tempFile, err := os.CreateTemp(narDir, ".tmp-"+sp.BasePath+"-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+	}()
+
+	nar, err := narBody(resp, sp)
+	if err != nil {
+		return err
+	}
+	fileHasher := sha256.New()
+	counter := &countingWriter{}
+	body := io.TeeReader(nar, io.MultiWriter(tempFile, fileHasher, counter))
+
+	// The narinfo written describes the NAR as decompressed
+	br := bufio.NewReaderSize(body, readBufferSize)
+	mismatch := servedNarMismatch(sp)
+	sp.Compression = narCompression(br, sp, mismatch)
+	reader, closeReader, err := decompress(br, sp.Compression)
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+
+	narHasher := sha256.New()
+	narReader := io.TeeReader(newNarSizeReader(reader, sp.NarSize), narHasher)
+	listing, err := narextract.List(narReader)
+	if err != nil {
+		return fmt.Errorf("failed to read NAR: %w", err)
+	}
+	// This also makes sure the whole compressed file went through the hasher
+	if err := checkNarEnd(narReader, br); err != nil {
+		return fmt.Errorf("failed to read NAR: %w", err)
+	}
+	computedHash := "sha256:" + nixBase32Encode(narHasher.Sum(nil))
+	if computedHash != sp.NarHash {
+		return fmt.Errorf("%w: expected %s, got %s", errHashMismatch, sp.NarHash, computedHash)
+	}
+
+	fileHash := "sha256:" + nixBase32Encode(fileHasher.Sum(nil))
+	if err := checkFileHash(sp, fileHash, counter.n, mismatch); err != nil {
+		return err
+	}
+
+	if sp.Compression == "unknown" {
+		if sp.Compression, err = sniffFileCompression(tempFile); err != nil {
+			return err
+		}
+	}
+	ext, err := compressionExtension(sp.Compression)
+	if err != nil {
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	narURL := "nar/" + strings.TrimPrefix(fileHash, "sha256:") + ".nar" + ext
+	if err := os.Rename(tempFile.Name(), filepath.Join(downloadOnlyDir, narURL)); err != nil {
+		return err
+	}
+
+	if listingDir != "" {
+		if err := writeListing(sp, listing); err != nil {
+			return fmt.Errorf("failed to write listing: %w", err)
+		}
+	}
+
+	hash, _, _ := strings.Cut(sp.BasePath, "-")
+	return writeFileAtomic(filepath.Join(downloadOnlyDir, hash+".narinfo"), formatNarInfo(sp, narURL, fileHash, counter.n))
+}
+
+// servedNarMismatch returns why the NAR of sp may legitimately differ from
+// the file described by the FileHash and FileSize of its narinfo, or "" if
+// they must match. Caches that recompress NARs can leave the FileHash of the
+// original file in the narinfo, which shows as a URL extension not matching
+// the Compression field.
+func servedNarMismatch(sp StorePath) string {
+	if sp.Compression == "unknown" {
+		return ""
+	}
+	narURL, _, _ := strings.Cut(sp.NarURL, "?")
+	name := path.Base(narURL)
+	for _, compression := range supportedCompressions {
+		ext, err := compressionExtension(compression)
+		if err != nil || compression == sp.Compression || !strings.HasSuffix(name, ".nar"+ext) {
+			continue
+		}
+		return fmt.Sprintf("its URL %s suggests %s compression, not %s", name, compression, sp.Compression)
+	}
+	return ""
+}
+
+// narCompression returns the compression the NAR of sp, read through br, is
+// decompressed with. That is the Compression declared by the narinfo unless
+// its URL suggests another one, as described by mismatch, and the first bytes
+// of the NAR show that the declared one is wrong: the NAR could then only fail
+// to decompress, and its NarHash is verified either way. Any mismatch is
+// logged as a warning.
+func narCompression(br *bufio.Reader, sp StorePath, mismatch string) string {
+	if mismatch == "" {
+		return sp.Compression
+	}
+	// Peek fails for short streams, which the decompressor rejects
+	header, _ := br.Peek(len(narMagic))
+	sniffed, err := sniffCompression(header)
+	if err != nil || sniffed == sp.Compression {
+		log.Printf("Warning: the narinfo of %s is inconsistent, %s; decompressing it as %s", sp.BasePath, mismatch, sp.Compression)
+		return sp.Compression
+	}
+	log.Printf("Warning: the narinfo of %s is inconsistent, %s; decompressing it as %s as detected from its contents", sp.BasePath, mismatch, sniffed)
+	return sniffed
+}
+
+// checkFileHash verifies the hash and size of a compressed NAR against the
+// FileHash and FileSize of its narinfo, if given. If mismatch, as returned by
+// servedNarMismatch, is set, differences are only logged: the NarHash of the
+// decompressed NAR is authoritative and has to be verified by the caller
+// before.
+func checkFileHash(sp StorePath, fileHash string, fileSize int64, mismatch string) error {
+	var err error
+	if expected, ok := sp.NarInfo["FileHash"]; ok && expected != fileHash {
+		err = fmt.Errorf("file %w: expected %s, got %s", errHashMismatch, expected, fileHash)
+	} else if _, ok := sp.NarInfo["FileSize"]; ok && sp.FileSize != fileSize {
+		err = fmt.Errorf("%w: expected file size %d, got %d", errHashMismatch, sp.FileSize, fileSize)
+	}
+	if err != nil && mismatch != "" {
+		log.Printf("Warning: not verifying the FileHash of %s as %s, its NarHash matches: %v", sp.BasePath, mismatch, err)
+		return nil
+	}
+	return err
+}
+
+// keptNar copies the compressed NAR of a path read through Body to the
+// -keep-nar directory while the path is extracted.
+type keptNar struct {
+	Body    io.Reader
+	file    *os.File
+	hasher  hash.Hash
+	counter countingWriter
+	// mismatch is the result of servedNarMismatch for the response
+	mismatch string
+}
+
+func newKeptNar(body io.Reader, sp StorePath, mismatch string) (*keptNar, error) {
+	f, err := os.CreateTemp(keepNarDir, ".tmp-"+sp.BasePath+"-*")
+	if err != nil {
+		return nil, err
+	}
+	kn := &keptNar{file: f, hasher: sha256.New(), mismatch: mismatch}
+	kn.Body = io.TeeReader(body, io.MultiWriter(f, kn.hasher, &kn.counter))
+	return kn, nil
+}
+
+// Finish reads the rest of the compressed NAR, verifies it and moves it to
+// <filehash>.nar<ext> in the -keep-nar directory.
+func (kn *keptNar) Finish(sp StorePath) error {
+	if _, err := io.Copy(io.Discard, kn.Body); err != nil {
+		return fmt.Errorf("failed to fetch NAR: %w", err)
+	}
+	compression := sp.Compression
+	if compression == "unknown" {
+		var err error
+		if compression, err = sniffFileCompression(kn.file); err != nil {
+			return err
+		}
+	}
+	ext, err := compressionExtension(compression)
+	if err != nil {
+		return err
+	}
+	fileHash := "sha256:" + nixBase32Encode(kn.hasher.Sum(nil))
+	if err := checkFileHash(sp, fileHash, kn.counter.n, kn.mismatch); err != nil {
+		return err
+	}
+	if err := kn.file.Close(); err != nil {
+		return err
+	}
+	name := strings.TrimPrefix(fileHash, "sha256:") + ".nar" + ext
+	return os.Rename(kn.file.Name(), filepath.Join(keepNarDir, name))
+}
+
+// Close removes the temporary file unless Finish moved it into place.
+func (kn *keptNar) Close() {
+	kn.file.Close()
+	os.Remove(kn.file.Name())
+}
+
+// formatNarInfo renders the narinfo of sp for a NAR stored at narURL. The
+// signatures stay valid since the URL and file fields are not signed.
+func formatNarInfo(sp StorePath, narURL, fileHash string, fileSize int64) []byte {
+	fields := make(map[string]string, len(sp.NarInfo))
+	for key, value := range sp.NarInfo {
+		fields[key] = value
+	}
+	fields["URL"] = narURL
+	fields["Compression"] = sp.Compression
+	fields["FileHash"] = fileHash
+	fields["FileSize"] = fmt.Sprint(fileSize)
+
+	var buf bytes.Buffer
+	for _, key := range narInfoFieldOrder {
+		if value, ok := fields[key]; ok {
+			fmt.Fprintf(&buf, "%s: %s\n", key, value)
+		}
+	}
+	var rest []string
+	for key := range fields {
+		if !slices.Contains(narInfoFieldOrder, key) {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	for _, key := range rest {
+		fmt.Fprintf(&buf, "%s: %s\n", key, fields[key])
+	}
+
+	text := buf.Bytes()
+	for _, sig := range sp.Sigs {
+		if signingKey != nil && strings.HasPrefix(sig, signingKey.name+":") {
+			continue
+		}
+		text = fmt.Appendf(text, "Sig: %s\n", sig)
+	}
+	if signingKey != nil {
+		text = appendSig(text, sp.NarInfo, *signingKey)
+	}
+	return text
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to name.
+func writeFileAtomic(name string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), ".tmp-"+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
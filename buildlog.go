@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// errNoBuildLog is returned by fetchBuildLog if no substituter has the log.
+var errNoBuildLog = errors.New("no log available")
+
+// printBuildLogs writes the build log of each of paths, base names, to stdout
+// and returns the exit status.
+func (d *Downloader) printBuildLogs(paths []string) int {
+	status := 0
+	for _, base := range paths {
+		if err := d.fetchBuildLog(os.Stdout, base); err != nil {
+			log.Printf("Failed to fetch the log of %s/%s: %v", storeDir, base, err)
+			if status == 0 {
+				status = exitCode(err)
+			}
+		}
+	}
+	return status
+}
+
+// fetchBuildLog writes the build log of the store path base, as served under
+// log/ by the first substituter having it, to w. Build logs are not signed.
+func (d *Downloader) fetchBuildLog(w io.Writer, base string) error {
+	var tried []string
+	notFound := true
+	for _, substituter := range d.Substituters {
+		if offline && !isLocalURL(substituter) {
+			continue
+		}
+		logURL, err := substituterURL(substituter, "log/"+base)
+		if err != nil {
+			return err
+		}
+		resp, err := httpGet(d.NarClient, logURL)
+		if err != nil {
+			tried = append(tried, substituter+": "+err.Error())
+			notFound = false
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			tried = append(tried, substituter+": "+resp.Status)
+			if resp.StatusCode != http.StatusNotFound {
+				notFound = false
+			}
+			continue
+		}
+		logf(1, "Fetching the log of %s from %s", base, substituter)
+		err = copyBuildLog(w, resp)
+		resp.Body.Close()
+		return err
+	}
+	switch {
+	case len(tried) == 0:
+		return fmt.Errorf("offline: no local substituter to fetch the log from")
+	case notFound:
+		return fmt.Errorf("%w (tried %s)", errNoBuildLog, strings.Join(tried, ", "))
+	default:
+		return &httpStatusError{"log", strings.Join(tried, ", ")}
+	}
+}
+
+// copyBuildLog writes the log served in resp to w. Caches compress logs
+// either with a Content-Encoding or, for file:// caches, in the file itself,
+// so both are undone.
+func copyBuildLog(w io.Writer, resp *http.Response) error {
+	var body io.Reader = resp.Body
+	encoding := resp.Header.Get("Content-Encoding")
+	switch encoding {
+	case "", "identity":
+		br := bufio.NewReader(body)
+		header, _ := br.Peek(len(narMagic))
+		body = br
+		if bytes.HasPrefix(header, []byte("BZh")) {
+			encoding = "bzip2"
+		} else if compression, err := sniffCompression(header); err == nil {
+			encoding = compression
+		}
+	case "x-gzip":
+		encoding = "gzip"
+	case "x-bzip2":
+		encoding = "bzip2"
+	}
+
+	switch encoding {
+	case "", "identity", "none":
+	case "bzip2":
+		body = bzip2.NewReader(body)
+	case "gzip", "xz", "zstd":
+		reader, closeReader, err := decompress(body, encoding)
+		if err != nil {
+			return err
+		}
+		defer closeReader()
+		body = reader
+	default:
+		return fmt.Errorf("unsupported compression of log: %s", encoding)
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		return fmt.Errorf("failed to fetch log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// makeStorePath returns the store path named name for the sha256 hash of
+// the given type, which Nix computes for all kinds of store paths.
+func makeStorePath(typ string, hash []byte, name string) string {
+	fingerprint := typ + ":sha256:" + hex.EncodeToString(hash) + ":" + storeDir + ":" + name
+	h := sha256.Sum256([]byte(fingerprint))
+	return storeDir + "/" + nixBase32Encode(compressHash(h[:], 20)) + "-" + name
+}
+
+// compressHash folds hash into size bytes by xoring, like Nix does for the
+// hash part of store paths.
+func compressHash(hash []byte, size int) []byte {
+	compressed := make([]byte, size)
+	for i, b := range hash {
+		compressed[i%size] ^= b
+	}
+	return compressed
+}
+
+// checkContentAddress succeeds if narInfo describes a content-addressed path
+// whose store path follows from its CA field and references, and whose
+// NarHash is the hash of the CA field. Nix trusts such paths without a
+// signature, as the NarHash is verified on download.
+//
+// Only paths addressed by the sha256 of their NAR (fixed:r:sha256, used for
+// content-addressed derivation outputs and most sources) are supported.
+// Flat and text hashes cover the file contents rather than the NAR, so those
+// paths still need a signature.
+func checkContentAddress(narInfo map[string]string) error {
+	ca := narInfo["CA"]
+	encoded, ok := strings.CutPrefix(ca, "fixed:r:sha256:")
+	if !ok {
+		return fmt.Errorf("unsupported content address %q, only fixed:r:sha256 can be verified", ca)
+	}
+	var hash []byte
+	var err error
+	if len(encoded) == 64 {
+		hash, err = hex.DecodeString(encoded)
+	} else {
+		hash, err = nixBase32Decode(encoded)
+	}
+	if err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("invalid content address %q", ca)
+	}
+
+	narHash, err := nixBase32Decode(strings.TrimPrefix(narInfo["NarHash"], "sha256:"))
+	if err != nil || !bytes.Equal(narHash, hash) {
+		return errors.New("NarHash does not match the content address")
+	}
+
+	storePath := narInfo["StorePath"]
+	base := filepath.Base(storePath)
+	_, name, _ := strings.Cut(base, "-")
+	refs := strings.Fields(narInfo["References"])
+	slices.Sort(refs)
+	typ := "source"
+	self := false
+	for _, ref := range refs {
+		if ref == base {
+			self = true
+			continue
+		}
+		typ += ":" + storeDir + "/" + ref
+	}
+	if self {
+		typ += ":self"
+	}
+	if expected := makeStorePath(typ, hash, name); expected != storePath {
+		return fmt.Errorf("content address does not match the store path, expected %s", expected)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// cacheInfo holds the fields of a substituter's nix-cache-info file.
+type cacheInfo struct {
+	StoreDir      string
+	Priority      int
+	WantMassQuery bool
+}
+
+// defaultPriority is the priority Nix assumes for substituters without one.
+const defaultPriority = 50
+
+// cacheInfos caches the probed nix-cache-info of each substituter for the run.
+var cacheInfos = map[string]cacheInfo{}
+
+// Substituters that set WantMassQuery welcome many concurrent narinfo
+// queries, all others get only a few at a time.
+const (
+	massQueryJobs = 16
+	defaultJobs   = 2
+)
+
+// narInfoSlots limits the concurrent narinfo queries per substituter.
+var narInfoSlots = map[string]chan struct{}{}
+
+// acquireNarInfoSlot blocks until another narinfo query may be sent to
+// substituter and returns a function to release the slot.
+func acquireNarInfoSlot(substituter string) func() {
+	slots, ok := narInfoSlots[substituter]
+	if !ok {
+		return func() {}
+	}
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
+func (d *Downloader) fetchCacheInfo(substituter string) (cacheInfo, error) {
+	info := cacheInfo{Priority: defaultPriority}
+	infoURL, err := substituterURL(substituter, "nix-cache-info")
+	if err != nil {
+		return info, err
+	}
+	resp, err := httpGet(d.NarInfoClient, infoURL)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return info, &httpStatusError{"nix-cache-info", resp.Status}
+	}
+
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxNarInfoSize))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSuffix(scanner.Text(), "\r"), ": ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "StoreDir":
+			info.StoreDir = value
+		case "Priority":
+			priority, err := strconv.Atoi(value)
+			if err != nil {
+				return info, fmt.Errorf("invalid Priority: %w", err)
+			}
+			info.Priority = priority
+		case "WantMassQuery":
+			info.WantMassQuery = value == "1"
+		}
+	}
+	return info, scanner.Err()
+}
+
+// probeSubstituters fetches the nix-cache-info of all substituters, drops the
+// ones serving a different store directory and sorts the remaining ones by
+// ascending priority, keeping the command line order on ties.
+func (d *Downloader) probeSubstituters() {
+	var usable, rejected []string
+	for _, substituter := range d.Substituters {
+		if offline && !isLocalURL(substituter) {
+			usable = append(usable, substituter)
+			continue
+		}
+		info, err := d.fetchCacheInfo(substituter)
+		if err != nil {
+			logf(1, "Could not probe %s, assuming defaults: %v", substituter, err)
+		}
+		if info.StoreDir != "" && info.StoreDir != storeDir {
+			rejected = append(rejected, fmt.Sprintf("%s (StoreDir %s)", substituter, info.StoreDir))
+			log.Printf("Warning: not using substituter %s, it serves store directory %s but narinfo signatures are verified for %s (see -store-dir)", substituter, info.StoreDir, storeDir)
+			continue
+		}
+		cacheInfos[substituter] = info
+		jobs := defaultJobs
+		if info.WantMassQuery {
+			jobs = massQueryJobs
+		}
+		narInfoSlots[substituter] = make(chan struct{}, jobs)
+		usable = append(usable, substituter)
+	}
+
+	if len(usable) == 0 && len(rejected) > 0 {
+		log.Fatalf("No usable substituter, all serve a store directory other than %s: %s", storeDir, strings.Join(rejected, ", "))
+	}
+
+	slices.SortStableFunc(usable, func(a, b string) int {
+		return substituterPriority(a) - substituterPriority(b)
+	})
+	d.Substituters = usable
+}
+
+func substituterPriority(substituter string) int {
+	if info, ok := cacheInfos[substituter]; ok {
+		return info.Priority
+	}
+	return defaultPriority
+}
@@ -26,5 +26,9 @@ func main() {
 		os.Exit(1)
 	}
 
+	for _, path := range extractor.SymlinkFallbacks() {
+		fmt.Fprintf(os.Stderr, "Warning: could not create symlink %s, wrote its target to a file instead\n", path)
+	}
+
 	fmt.Println("NAR extracted successfully.")
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// commands are the subcommands of nix-download, a bare nix-download <path> is
+// short for download.
+var commands = []struct {
+	name    string
+	args    string
+	summary string
+}{
+	{"download", "<store path>...", "Download store paths and their closure into the store"},
+	{"verify", "<store path>...", "Check store paths in the store against the NarHash of their narinfo"},
+	{"copy", "-to <dir> <store path>...", "Copy store paths and their closure to a binary cache directory"},
+	{"list", "<store path>...", "Print the paths of the closure that would be downloaded"},
+	{"pack", "<store path>...", "Write store paths and their closure to stdout in the nix-store --import format"},
+	{"narinfo", "<store path>...", "Print the verified narinfo of store paths as JSON"},
+	{"log", "<store path>...", "Print the build logs of store paths served by the substituters"},
+	{"prefetch", "<url or store path>...", "Print the hash of files or store paths in the format used by Nix expressions"},
+	{"import", "-hash <hash> <nar file|-> <store path>", "Extract a local NAR file into the store after verifying its hash"},
+	{"completion", "bash|zsh|fish", "Print a shell completion script"},
+	{"version", "", "Print the version"},
+}
+
+func isCommand(name string) bool {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newFlagSet returns the flags of the command name, which are stored in the
+// globals and opts.
+func newFlagSet(name string, opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("nix-download "+name, flag.ExitOnError)
+	fs.Usage = func() { printUsage(fs, name) }
+
+	switch name {
+	case "download":
+		addCommonFlags(fs, opts)
+		addFetchFlags(fs, opts)
+		addListFlags(fs)
+		fs.StringVar(&opts.secretKeyFile, "secret-key-file", "", "File containing a secret key in the format name:base64secret used to sign narinfos")
+		fs.StringVar(&downloadOnlyDir, "download-only", "", "Store the compressed NARs and narinfos in this directory as a binary cache instead of extracting them")
+		fs.BoolVar(&useDaemon, "use-daemon", false, "Import the paths with the nix-daemon instead of writing to the store directly")
+		fs.BoolVar(&exportNars, "export", false, "Write the paths to stdout in the format read by nix-store --import instead of writing to the store")
+		fs.BoolVar(&dryRun, "dry-run", false, "Only print the paths that would be downloaded")
+		fs.StringVar(&keepNarDir, "keep-nar", "", "Also keep the compressed NARs of the extracted paths in this directory")
+		fs.StringVar(&deltaBase, "base", "", "Store path similar to the requested ones whose files are reused (requires -experimental-delta)")
+		fs.BoolVar(&opts.experimentalDelta, "experimental-delta", false, "Enable delta downloads against the -base path")
+		fs.BoolVar(&paranoid, "paranoid", false, "Check paths already in the store against their narinfo and download them again if they differ")
+		fs.BoolVar(&optimise, "optimise", false, "Hard link identical files of the downloaded paths via the store's .links directory")
+		fs.StringVar(&postExtract, "post-extract", "", "Command to run with the store path as argument after each path is downloaded")
+		fs.StringVar(&gcRootDir, "gc-root", "", "Directory to create links to the requested paths in, registered as indirect garbage collector roots")
+		fs.BoolVar(&opts.showVersion, "version", false, "Print the version and exit")
+	case "copy":
+		addCommonFlags(fs, opts)
+		addFetchFlags(fs, opts)
+		fs.StringVar(&downloadOnlyDir, "to", "", "Binary cache directory to copy the paths to")
+		fs.StringVar(&opts.secretKeyFile, "secret-key-file", "", "File containing a secret key in the format name:base64secret used to sign narinfos")
+	case "pack":
+		addCommonFlags(fs, opts)
+		addFetchFlags(fs, opts)
+	case "list":
+		addCommonFlags(fs, opts)
+		addListFlags(fs)
+		fs.StringVar(&opts.planFile, "from-plan", "", "Download the paths of this -discover-only plan instead of discovering the closure of the given paths")
+		fs.StringVar(&opts.preferCompression, "prefer-compression", "", "Comma separated list of compression types in order of preference, e.g. zstd,xz,none")
+		fs.IntVar(&discoveryJobs, "discovery-jobs", 32, "Number of narinfos fetched at the same time while discovering the closure")
+		fs.Var(&opts.refFilters, "ref-filter", "Only follow references whose name matches this glob, or skip them if it starts with ! (can be specified multiple times)")
+		fs.Var(&opts.excludeClosure, "exclude-closure", "Only download the paths the requested ones add to the closure of this path, which is treated as present (can be specified multiple times)")
+		fs.BoolVar(&withDebug, "with-debug", false, "Also list the debug outputs of the derivations of the listed paths, if the substituters have them")
+	case "verify", "narinfo", "log":
+		addCommonFlags(fs, opts)
+	case "import":
+		fs.StringVar(&opts.store, "store", "/nix/store", "Nix store root directory")
+		fs.StringVar(&storeDir, "store-dir", "/nix/store", "Logical store directory of the store paths")
+		fs.Var(verbosityFlag{&verbosity, 1}, "v", "Verbose output (can be specified multiple times)")
+		fs.Var(verbosityFlag{&verbosity, 2}, "vv", "Debug output, additionally logs decompression, hashes and timing")
+		fs.BoolVar(&quiet, "quiet", false, "Do not print the imported path, only errors")
+		fs.StringVar(&opts.narHash, "hash", "", "Expected NAR hash, as sha256:<nix base32 or hex> like the NarHash of narinfos or as SRI hash sha256-<base64>")
+		fs.Int64Var(&opts.narSize, "nar-size", -1, "Expected size of the decompressed NAR")
+		fs.StringVar(&opts.compression, "compression", "", "Compression of the NAR file, none, gzip, xz or zstd; detected from its first bytes by default")
+		fs.Var(&opts.zstdDicts, "zstd-dict", "File containing a zstd dictionary needed to decompress the NAR (can be specified multiple times)")
+		fs.StringVar(&listingDir, "ls-dir", "", "Directory to write a .ls file listing the NAR contents to")
+		fs.BoolVar(&optimise, "optimise", false, "Hard link identical files of the imported path via the store's .links directory")
+		fs.StringVar(&postExtract, "post-extract", "", "Command to run with the store path as argument after the path is imported")
+		fs.StringVar(&intoDir, "into", "", "Extract into this existing empty directory instead of the store, without the temporary directory and rename; the NAR must be of a directory")
+	case "prefetch":
+		addCommonFlags(fs, opts)
+		fs.BoolVar(&opts.printPath, "print-path", false, "Also print the store path")
+		fs.StringVar(&opts.name, "name", "", "Store path name of downloaded URLs, by default the last component of the URL")
+	case "completion":
+		fs.StringVar(&opts.store, "store", "/nix/store", "Nix store root directory whose paths are completed")
+	}
+	return fs
+}
+
+// addCommonFlags adds the flags selecting the store, the substituters and
+// the output shared by all commands working with store paths.
+func addCommonFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.store, "store", "/nix/store", "Nix store root directory")
+	fs.StringVar(&storeDir, "store-dir", "/nix/store", "Logical store directory of the store paths, used for signature verification")
+	fs.Var((*stringSliceFlag)(&opts.substituters), "substituter", "URL of a binary cache (can be specified multiple times)")
+	fs.Var(&opts.publicKeys, "public-key", "Public key in the format name:base64pubkey (can be specified multiple times)")
+	fs.Var(&opts.allowUnsignedFrom, "allow-unsigned-from", "Trust narinfos served by this -substituter without signatures (can be specified multiple times)")
+	fs.Var(verbosityFlag{&verbosity, 1}, "v", "Verbose output, logs narinfo fetches (can be specified multiple times)")
+	fs.Var(verbosityFlag{&verbosity, 2}, "vv", "Debug output, additionally logs decompression, hashes and timing")
+	fs.BoolVar(&quiet, "quiet", false, "Do not print downloaded paths, only errors")
+	fs.BoolVar(&offline, "offline", false, "Only use file:// substituters and fail on anything that would need the network")
+	fs.StringVar(&userAgent, "user-agent", "nix-download/"+toolVersion(), "User-Agent header sent with all requests")
+	fs.StringVar(&opts.narInfoIndexFile, "narinfo-index", "", "File of trusted narinfo hashes, narinfos not listed in it with the same sha256 are rejected")
+	fs.DurationVar(&opts.deadline, "deadline", 0, "Abort discovery and downloads after this duration, e.g. 10m")
+}
+
+// addFetchFlags adds the flags of the commands fetching NARs.
+func addFetchFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&listingDir, "ls-dir", "", "Directory to write a .ls file listing the NAR contents of each downloaded path to")
+	fs.StringVar(&pathsFile, "write-paths", "", "Write the downloaded store paths to this file after the run")
+	fs.Var(&opts.refFilters, "ref-filter", "Only follow references whose name matches this glob, or skip them if it starts with ! (can be specified multiple times)")
+	fs.Var(&opts.excludeClosure, "exclude-closure", "Only download the paths the requested ones add to the closure of this path, which is treated as present (can be specified multiple times)")
+	fs.BoolVar(&withDebug, "with-debug", false, "Also download the debug outputs of the derivations of the downloaded paths, if the substituters have them")
+	fs.BoolVar(&traceTiming, "trace-timing", false, "Print where the time of the run was spent, for the whole run and the slowest paths")
+	fs.StringVar(&metricsFile, "metrics-file", "", "Write Prometheus metrics of the run to this file, e.g. for the node_exporter textfile collector")
+	fs.BoolVar(&withPresent, "include-present", false, "Also list already present paths in the -write-paths file")
+	fs.BoolVar(&keepGoing, "keep-going", false, "Skip paths that cannot be fetched and download the rest of the closure")
+	fs.IntVar(&opts.progressFd, "progress-fd", -1, "File descriptor to write JSON progress events to")
+	fs.BoolVar(&jsonOutput, "json", false, "Print one JSON object per downloaded path instead of plain paths")
+	fs.BoolVar(&opts.checkClosure, "check-closure", false, "Verify that all references of the discovered paths are present or downloaded before downloading anything")
+	fs.StringVar(&opts.stateFile, "state", "", "File recording the completed paths, a resumed run skips the narinfos of paths listed in it")
+	fs.Var(&opts.zstdDicts, "zstd-dict", "File containing a zstd dictionary needed to decompress NARs compressed with it (can be specified multiple times)")
+	fs.StringVar(&opts.readBufferSize, "read-buffer-size", "", "Size of the buffer NAR downloads are read through, e.g. 1M (default 64K, at least 4K)")
+	fs.StringVar(&opts.maxMemory, "max-memory", "", "Limit the total NarSize of the paths decompressed at the same time, e.g. 512M, larger paths are processed alone")
+	fs.StringVar(&opts.allowCompression, "allow-compression", "", "Comma separated list of compression types that may be downloaded, e.g. zstd,none")
+	fs.StringVar(&opts.preferCompression, "prefer-compression", "", "Comma separated list of compression types in order of preference, e.g. zstd,xz,none")
+	fs.StringVar(&opts.planFile, "from-plan", "", "Download the paths of this -discover-only plan instead of discovering the closure of the given paths")
+	fs.IntVar(&jobs, "jobs", 8, "Number of NARs downloaded at the same time")
+	fs.IntVar(&perSubstituterJobs, "per-substituter-jobs", 0, "Number of NARs downloaded at the same time from each substituter, paths are taken from another substituter having them if one is busy (default no limit)")
+	fs.IntVar(&parallelRoots, "parallel-roots", 0, "Number of root paths discovered and downloaded on their own at the same time, sharing the -jobs (default all roots in a single pass)")
+	fs.IntVar(&discoveryJobs, "discovery-jobs", 32, "Number of narinfos fetched at the same time while discovering the closure")
+}
+
+// addListFlags adds the flags printing information about the closure instead
+// of downloading it.
+func addListFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&printMissing, "print-missing", false, "Only print the paths of the closure that no substituter has")
+	fs.StringVar(&printGraphFormat, "print-graph", "", "Only print the reference graph of the closure in this format, dot or json")
+	fs.BoolVar(&closureSize, "closure-size", false, "Only print the number of paths and total size of the closure")
+	fs.BoolVar(&discoverOnly, "discover-only", false, "Only print the narinfos of the paths to download as a JSON plan for -from-plan")
+}
+
+func printUsage(fs *flag.FlagSet, name string) {
+	w := fs.Output()
+	for _, cmd := range commands {
+		if cmd.name == name {
+			fmt.Fprintf(w, "Usage: nix-download %s [flags] %s\n\n%s.\n", name, cmd.args, cmd.summary)
+		}
+	}
+	if name == "download" {
+		fmt.Fprintf(w, "\nnix-download <store path>... is short for nix-download download.\n\nCommands:\n")
+		for _, cmd := range commands {
+			fmt.Fprintf(w, "  %-10s  %s\n", cmd.name, cmd.summary)
+		}
+	}
+	fmt.Fprintf(w, "\nFlags:\n")
+	fs.PrintDefaults()
+
+	if fs.Lookup("substituter") == nil {
+		return
+	}
+	fmt.Fprintf(w, `
+Store paths can be given as /nix/store/<hash>-<name> or <hash>-<name>.
+
+Unless -substituter is given, %s is used. Narinfos must be signed
+by one of the -public-key keys, by default
+  %s
+Keys have the format name:base64 used by trusted-public-keys in nix.conf, the
+key name (usually the host name of the cache and a number) followed by the
+base64 encoded ed25519 public key.
+
+Examples:
+`, defaultSubstituter, defaultPublicKey)
+	for _, example := range usageExamples[name] {
+		fmt.Fprintf(w, "  %s\n", example)
+	}
+}
+
+// usageExamples are the examples shown in the help of each command.
+var usageExamples = map[string][]string{
+	"download": {
+		"nix-download /nix/store/39z5zpb72qrnxl832nwphcd4ihfhix3j-hello-2.12.1",
+		"nix-download -store ~/nix/store -substituter https://cache.example.org -public-key cache.example.org-1:<base64> <store path>",
+		"nix-download -export <store path> | nix-store --import",
+	},
+	"verify": {
+		"nix-download verify /nix/store/39z5zpb72qrnxl832nwphcd4ihfhix3j-hello-2.12.1",
+	},
+	"copy": {
+		"nix-download copy -to ./cache /nix/store/39z5zpb72qrnxl832nwphcd4ihfhix3j-hello-2.12.1",
+	},
+	"list": {
+		"nix-download list -closure-size /nix/store/39z5zpb72qrnxl832nwphcd4ihfhix3j-hello-2.12.1",
+		"nix-download list -print-graph dot <store path> | dot -Tsvg > closure.svg",
+	},
+	"log": {
+		"nix-download log /nix/store/39z5zpb72qrnxl832nwphcd4ihfhix3j-hello-2.12.1",
+	},
+	"narinfo": {
+		"nix-download narinfo /nix/store/39z5zpb72qrnxl832nwphcd4ihfhix3j-hello-2.12.1 | jq .narHash",
+	},
+	"prefetch": {
+		"nix-download prefetch https://ftp.gnu.org/gnu/hello/hello-2.12.1.tar.gz",
+		"nix-download prefetch -print-path /nix/store/39z5zpb72qrnxl832nwphcd4ihfhix3j-hello-2.12.1",
+	},
+	"import": {
+		"nix-download import -hash sha256-<base64> ./hello.nar.xz /nix/store/39z5zpb72qrnxl832nwphcd4ihfhix3j-hello-2.12.1",
+		"ssh host nix-store --dump /nix/store/<path> | nix-download import -hash <hash> - /nix/store/<path>",
+	},
+	"pack": {
+		"nix-download pack /nix/store/39z5zpb72qrnxl832nwphcd4ihfhix3j-hello-2.12.1 | ssh host nix-store --import",
+	},
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// completionFlag describes a flag for the completion scripts.
+type completionFlag struct {
+	name    string
+	usage   string
+	isValue bool
+}
+
+func completionFlags(fs *flag.FlagSet) []completionFlag {
+	var flags []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		isBool := false
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok {
+			isBool = b.IsBoolFlag()
+		}
+		flags = append(flags, completionFlag{name: f.Name, usage: f.Usage, isValue: !isBool})
+	})
+	return flags
+}
+
+// printCompletion writes the completion script for shell to w covering the
+// commands and the flags in fs. Store paths are completed from store.
+func printCompletion(w io.Writer, shell, store string, fs *flag.FlagSet) error {
+	flags := completionFlags(fs)
+	names := make([]string, len(commands))
+	for i, cmd := range commands {
+		names[i] = cmd.name
+	}
+	switch shell {
+	case "bash":
+		flagNames := make([]string, len(flags))
+		for i, f := range flags {
+			flagNames[i] = "-" + f.name
+		}
+		fmt.Fprintf(w, `_nix_download() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local prev="${COMP_WORDS[COMP_CWORD-1]}"
+    case "$prev" in
+        %s)
+            COMPREPLY=($(compgen -f -- "$cur"))
+            return
+            ;;
+    esac
+    if [[ "$cur" == -* ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+    elif [[ $COMP_CWORD -eq 1 && "$cur" != */* ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur") $(compgen -f -- "%s/$cur"))
+    else
+        COMPREPLY=($(compgen -f -- "${cur:-%s/}"))
+    fi
+}
+complete -F _nix_download nix-download
+`, strings.Join(valueFlagNames(flags), "|"), strings.Join(flagNames, " "), strings.Join(names, " "), store, store)
+	case "zsh":
+		fmt.Fprintf(w, "#compdef nix-download\n\nlocal store=%s\n\n_arguments \\\n", shellQuote(store))
+		for _, f := range flags {
+			usage := zshEscape(f.usage)
+			if f.isValue {
+				fmt.Fprintf(w, "  '-%s[%s]:value:_files' \\\n", f.name, usage)
+			} else {
+				fmt.Fprintf(w, "  '-%s[%s]' \\\n", f.name, usage)
+			}
+		}
+		fmt.Fprintf(w, "  '1:command or store path:_alternative \"commands:command:(%s)\" \"paths:store path:_files -W $store\"' \\\n", strings.Join(names, " "))
+		fmt.Fprintf(w, "  '*:store path:_files -W $store'\n")
+	case "fish":
+		fmt.Fprintf(w, "complete -c nix-download -f -n __fish_use_subcommand -a %s\n", shellQuote(strings.Join(names, " ")))
+		fmt.Fprintf(w, "complete -c nix-download -f -a '(command ls %s 2>/dev/null)'\n", shellQuote(store))
+		for _, f := range flags {
+			required := ""
+			if f.isValue {
+				required = " -r -F"
+			}
+			fmt.Fprintf(w, "complete -c nix-download -o %s%s -d %s\n", f.name, required, shellQuote(f.usage))
+		}
+	default:
+		return fmt.Errorf("unsupported shell: %s", shell)
+	}
+	return nil
+}
+
+func valueFlagNames(flags []completionFlag) []string {
+	var names []string
+	for _, f := range flags {
+		if f.isValue {
+			names = append(names, "-"+f.name)
+		}
+	}
+	return names
+}
+
+// zshEscape escapes the characters with a special meaning in an _arguments
+// description, the result is single quoted.
+func zshEscape(s string) string {
+	s = strings.NewReplacer("[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+	return strings.ReplaceAll(s, "'", `'\''`)
+}
+
+// shellQuote single quotes s for sh, zsh and fish.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
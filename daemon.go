@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/simonfxr/nix-download/narextract"
+)
+
+// Constants of the Nix worker protocol spoken on the daemon socket.
+const (
+	workerMagic1 = 0x6e697863
+	workerMagic2 = 0x6478696f
+
+	// daemonProtocolVersion is 1.32, AddToStoreNar with a framed NAR needs
+	// at least 1.23 on the daemon side.
+	daemonProtocolVersion = 1<<8 | 32
+	minDaemonVersion      = 1<<8 | 23
+
+	opAddToStoreNar = 39
+
+	stderrNext          = 0x6f6c6d67
+	stderrRead          = 0x64617461
+	stderrWrite         = 0x64617416
+	stderrLast          = 0x616c7473
+	stderrError         = 0x63787470
+	stderrStartActivity = 0x53545254
+	stderrStopActivity  = 0x53544f50
+	stderrResult        = 0x52534c54
+)
+
+// daemonFrameSize is the size of the chunks a NAR is sent to the daemon in.
+const daemonFrameSize = 64 * 1024
+
+// daemonConn is a connection to the nix-daemon.
+type daemonConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	version uint64
+}
+
+func dialDaemon() (*daemonConn, error) {
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(runCtx, "unix", daemonSocket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nix-daemon: %w", err)
+	}
+	dc := &daemonConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if err := dc.handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("nix-daemon handshake failed: %w", err)
+	}
+	return dc, nil
+}
+
+func (dc *daemonConn) Close() error {
+	return dc.conn.Close()
+}
+
+func (dc *daemonConn) handshake() error {
+	dc.writeInt(workerMagic1)
+	if err := dc.w.Flush(); err != nil {
+		return err
+	}
+	magic, err := dc.readInt()
+	if err != nil {
+		return err
+	}
+	if magic != workerMagic2 {
+		return fmt.Errorf("unexpected magic %#x", magic)
+	}
+	serverVersion, err := dc.readInt()
+	if err != nil {
+		return err
+	}
+	if serverVersion>>8 != 1 || serverVersion < minDaemonVersion {
+		return fmt.Errorf("unsupported protocol version %d.%d", serverVersion>>8, serverVersion&0xff)
+	}
+	dc.version = min(serverVersion, daemonProtocolVersion)
+
+	dc.writeInt(daemonProtocolVersion)
+	// Obsolete CPU affinity and reserve space settings
+	dc.writeInt(0)
+	dc.writeInt(0)
+	if err := dc.w.Flush(); err != nil {
+		return err
+	}
+	return dc.processStderr()
+}
+
+func (dc *daemonConn) writeInt(n uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], n)
+	dc.w.Write(buf[:])
+}
+
+func (dc *daemonConn) writeBool(b bool) {
+	if b {
+		dc.writeInt(1)
+	} else {
+		dc.writeInt(0)
+	}
+}
+
+func (dc *daemonConn) writeString(s string) {
+	dc.writeInt(uint64(len(s)))
+	dc.w.WriteString(s)
+	if pad := (8 - len(s)%8) % 8; pad > 0 {
+		dc.w.Write(make([]byte, pad))
+	}
+}
+
+func (dc *daemonConn) writeStrings(ss []string) {
+	dc.writeInt(uint64(len(ss)))
+	for _, s := range ss {
+		dc.writeString(s)
+	}
+}
+
+func (dc *daemonConn) readInt() (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(dc.r, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+// maxDaemonString bounds the strings accepted from the daemon.
+const maxDaemonString = 16 * 1024 * 1024
+
+func (dc *daemonConn) readString() (string, error) {
+	n, err := dc.readInt()
+	if err != nil {
+		return "", err
+	}
+	if n > maxDaemonString {
+		return "", fmt.Errorf("string of %d bytes exceeds maximum size", n)
+	}
+	buf := make([]byte, n+(8-n%8)%8)
+	if _, err := io.ReadFull(dc.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+// skipFields skips the typed fields of an activity message.
+func (dc *daemonConn) skipFields() error {
+	n, err := dc.readInt()
+	if err != nil {
+		return err
+	}
+	for range n {
+		typ, err := dc.readInt()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 0:
+			_, err = dc.readInt()
+		case 1:
+			_, err = dc.readString()
+		default:
+			err = fmt.Errorf("unknown field type %d", typ)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processStderr reads the log messages the daemon sends while working on an
+// operation until it is done, forwarding them with -v, and returns the error
+// the operation failed with, if any.
+func (dc *daemonConn) processStderr() error {
+	for {
+		msg, err := dc.readInt()
+		if err != nil {
+			return err
+		}
+		switch msg {
+		case stderrLast:
+			return nil
+		case stderrError:
+			return dc.readError()
+		case stderrNext:
+			s, err := dc.readString()
+			if err != nil {
+				return err
+			}
+			logf(1, "nix-daemon: %s", strings.TrimSuffix(s, "\n"))
+		case stderrWrite:
+			if _, err := dc.readString(); err != nil {
+				return err
+			}
+		case stderrRead:
+			return errors.New("nix-daemon unexpectedly requested data")
+		case stderrStartActivity:
+			// id, level, type
+			for range 3 {
+				if _, err := dc.readInt(); err != nil {
+					return err
+				}
+			}
+			s, err := dc.readString()
+			if err != nil {
+				return err
+			}
+			if err := dc.skipFields(); err != nil {
+				return err
+			}
+			// parent
+			if _, err := dc.readInt(); err != nil {
+				return err
+			}
+			if s != "" {
+				logf(2, "nix-daemon: %s", s)
+			}
+		case stderrStopActivity:
+			if _, err := dc.readInt(); err != nil {
+				return err
+			}
+		case stderrResult:
+			// id, type
+			for range 2 {
+				if _, err := dc.readInt(); err != nil {
+					return err
+				}
+			}
+			if err := dc.skipFields(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown message %#x from nix-daemon", msg)
+		}
+	}
+}
+
+// readError reads the error the daemon reports for a failed operation.
+func (dc *daemonConn) readError() error {
+	if dc.version&0xff < 26 {
+		msg, err := dc.readString()
+		if err != nil {
+			return err
+		}
+		if _, err := dc.readInt(); err != nil {
+			return err
+		}
+		return daemonError(msg)
+	}
+
+	// type, level, name
+	if _, err := dc.readString(); err != nil {
+		return err
+	}
+	if _, err := dc.readInt(); err != nil {
+		return err
+	}
+	if _, err := dc.readString(); err != nil {
+		return err
+	}
+	msg, err := dc.readString()
+	if err != nil {
+		return err
+	}
+	// The position is never sent, only the havePos flag
+	if _, err := dc.readInt(); err != nil {
+		return err
+	}
+	nrTraces, err := dc.readInt()
+	if err != nil {
+		return err
+	}
+	for range nrTraces {
+		if _, err := dc.readInt(); err != nil {
+			return err
+		}
+		if _, err := dc.readString(); err != nil {
+			return err
+		}
+	}
+	return daemonError(msg)
+}
+
+// daemonError is an error reported by the daemon for a failed operation.
+type daemonError string
+
+func (e daemonError) Error() string {
+	return "nix-daemon: " + string(e)
+}
+
+// framedWriter writes to the daemon in length prefixed frames, a zero length
+// frame ends the stream.
+type framedWriter struct {
+	dc *daemonConn
+}
+
+func (fw framedWriter) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		n := min(len(p)-written, daemonFrameSize)
+		fw.dc.writeInt(uint64(n))
+		if _, err := fw.dc.w.Write(p[written : written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return len(p), nil
+}
+
+func (fw framedWriter) Close() error {
+	fw.dc.writeInt(0)
+	return fw.dc.w.Flush()
+}
+
+// addToStoreNar imports sp into the daemon's store, writeNar must copy the
+// whole NAR to the given writer.
+func (dc *daemonConn) addToStoreNar(sp StorePath, writeNar func(w io.Writer) error) error {
+	digest, err := nixBase32Decode(strings.TrimPrefix(sp.NarHash, "sha256:"))
+	if err != nil {
+		return fmt.Errorf("invalid NarHash %s: %w", sp.NarHash, err)
+	}
+	references := make([]string, len(sp.References))
+	for i, ref := range sp.References {
+		references[i] = storeDir + "/" + ref
+	}
+	deriver := ""
+	if d, ok := sp.NarInfo["Deriver"]; ok && d != "unknown-deriver" {
+		deriver = storeDir + "/" + d
+	}
+
+	dc.writeInt(opAddToStoreNar)
+	dc.writeString(storeDir + "/" + sp.BasePath)
+	dc.writeString(deriver)
+	dc.writeString(hex.EncodeToString(digest))
+	dc.writeStrings(references)
+	dc.writeInt(0) // registration time, set by the daemon
+	dc.writeInt(uint64(sp.NarSize))
+	dc.writeBool(false) // ultimate
+	dc.writeStrings(sp.Sigs)
+	dc.writeString(sp.NarInfo["CA"])
+	dc.writeBool(false) // repair
+	dc.writeBool(false) // dontCheckSigs, the daemon checks them against its own keys
+
+	// The daemon may log or fail while the NAR is still being sent, so its
+	// messages are processed concurrently. Closing the connection unblocks
+	// whichever side is still waiting when the other one fails.
+	sent := make(chan error, 1)
+	go func() {
+		fw := framedWriter{dc}
+		err := writeNar(fw)
+		if err == nil {
+			err = fw.Close()
+		}
+		if err != nil {
+			dc.conn.Close()
+		}
+		sent <- err
+	}()
+
+	err = dc.processStderr()
+	if err != nil {
+		dc.conn.Close()
+	}
+	sendErr := <-sent
+	var reported daemonError
+	if sendErr != nil && !errors.As(err, &reported) {
+		return sendErr
+	}
+	return err
+}
+
+// importNar fetches the NAR of sp and imports it with the nix-daemon for
+// -use-daemon. The NarHash is verified both here and by the daemon.
+func (d *Downloader) importNar(destPath string, sp StorePath) error {
+	start := time.Now()
+
+	if offline && !isLocalURL(sp.NarURL) {
+		return fmt.Errorf("offline: NAR %s requires a network fetch", sp.NarURL)
+	}
+
+	release, err := acquireNarMemory(sp)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	resp, err := httpGet(d.NarClient, sp.NarURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch NAR: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &httpStatusError{"NAR", resp.Status}
+	}
+
+	body, err := narBody(resp, sp)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(body, readBufferSize)
+	compression := narCompression(br, sp, servedNarMismatch(sp))
+	logf(2, "Decompressing %s with %s", sp.BasePath, compression)
+	reader, closeReader, err := decompress(br, compression)
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+
+	var limitedReader io.Reader = newNarSizeReader(reader, sp.NarSize)
+	if progress.w != nil {
+		limitedReader = &progressReader{r: limitedReader, path: destPath, total: sp.NarSize}
+	}
+	narHasher := sha256.New()
+	narReader := io.TeeReader(limitedReader, narHasher)
+
+	dc, err := dialDaemon()
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	var listing *narextract.Entry
+	err = dc.addToStoreNar(sp, func(w io.Writer) error {
+		src := io.TeeReader(narReader, w)
+		if listingDir != "" {
+			var err error
+			if listing, err = narextract.List(src); err != nil {
+				return fmt.Errorf("failed to read NAR: %w", err)
+			}
+		}
+		if err := checkNarEnd(src, br); err != nil {
+			return fmt.Errorf("failed to fetch NAR: %w", err)
+		}
+		computedHash := "sha256:" + nixBase32Encode(narHasher.Sum(nil))
+		if computedHash != sp.NarHash {
+			return fmt.Errorf("%w: expected %s, got %s", errHashMismatch, sp.NarHash, computedHash)
+		}
+		logf(2, "Verified %s: %s", sp.BasePath, computedHash)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import NAR: %w", err)
+	}
+
+	if listing != nil {
+		if err := writeListing(sp, listing); err != nil {
+			return fmt.Errorf("failed to write listing: %w", err)
+		}
+	}
+
+	logf(2, "Imported %s in %s", sp.BasePath, time.Since(start))
+
+	if postExtract != "" {
+		if err := runPostExtract(destPath); err != nil {
+			return fmt.Errorf("post-extract command failed: %w", err)
+		}
+	}
+
+	return nil
+}
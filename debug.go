@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/simonfxr/nix-download/narextract"
+)
+
+// withDebug also downloads the debug outputs of the derivations of the
+// downloaded paths, if the substituters have them
+var withDebug = false
+
+// maxDrvSize bounds the NarSize of the derivations fetched for -with-debug.
+const maxDrvSize = 16 << 20
+
+// debugOutputs caches the base name of the debug output of each deriver, ""
+// if it has none, since all outputs of a derivation share the deriver.
+var debugOutputs sync.Map
+
+// debugOutput returns the base name of the debug output of the derivation
+// that produced sp, or "" if it is not known. The derivation is looked up by
+// the Deriver of the narinfo on the substituters like any store path, caches
+// only have it if it was uploaded with its outputs, e.g. by nix copy
+// --derivation.
+func (d *Downloader) debugOutput(sp StorePath) string {
+	deriver := sp.NarInfo["Deriver"]
+	if deriver == "" || deriver == "unknown-deriver" {
+		return ""
+	}
+	if base, ok := debugOutputs.Load(deriver); ok {
+		return base.(string)
+	}
+	base, err := d.fetchDebugOutput(deriver)
+	if err != nil {
+		logf(1, "No debug output of %s/%s: %v", storeDir, sp.BasePath, err)
+	}
+	debugOutputs.Store(deriver, base)
+	return base
+}
+
+// fetchDebugOutput fetches the derivation deriver and returns the base name
+// of its debug output.
+func (d *Downloader) fetchDebugOutput(deriver string) (string, error) {
+	drv, err := d.fetchNarInfo(deriver)
+	if err != nil {
+		return "", err
+	}
+	if drv.NarSize > maxDrvSize {
+		return "", fmt.Errorf("%s is too large: %s", deriver, formatSize(drv.NarSize))
+	}
+	if offline && !isLocalURL(drv.NarURL) {
+		return "", fmt.Errorf("offline: NAR %s requires a network fetch", drv.NarURL)
+	}
+	resp, err := httpGet(d.NarClient, drv.NarURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch NAR: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &httpStatusError{"NAR", resp.Status}
+	}
+	body, err := narBody(resp, drv)
+	if err != nil {
+		return "", err
+	}
+	reader, closeReader, err := decompress(body, drv.Compression)
+	if err != nil {
+		return "", err
+	}
+	defer closeReader()
+
+	hasher := sha256.New()
+	var contents bytes.Buffer
+	nar := io.TeeReader(newNarSizeReader(reader, drv.NarSize), hasher)
+	if _, err := narextract.ExtractSingleFile(nar, &contents); err != nil {
+		return "", fmt.Errorf("failed to extract %s: %w", deriver, err)
+	}
+	if computedHash := "sha256:" + nixBase32Encode(hasher.Sum(nil)); computedHash != drv.NarHash {
+		return "", fmt.Errorf("%w: expected %s, got %s", errHashMismatch, drv.NarHash, computedHash)
+	}
+
+	outputs, err := parseDerivationOutputs(contents.String())
+	if err != nil {
+		return "", fmt.Errorf("invalid derivation %s: %w", deriver, err)
+	}
+	path, ok := outputs["debug"]
+	if !ok {
+		return "", nil
+	}
+	base, err := parseStoreBase(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid debug output of %s: %w", deriver, err)
+	}
+	return base, nil
+}
+
+// errInvalidDerivation is returned for derivations that are not in the ATerm
+// format of .drv files.
+var errInvalidDerivation = errors.New("not a derivation")
+
+// parseDerivationOutputs returns the paths of the outputs of the derivation
+// drv, the contents of a .drv file starting with
+// Derive([("out","/nix/store/...","",""),...],...). Outputs of content
+// addressed derivations have no path and are left out.
+func parseDerivationOutputs(drv string) (map[string]string, error) {
+	rest, ok := strings.CutPrefix(drv, "Derive([")
+	if !ok {
+		return nil, errInvalidDerivation
+	}
+	outputs := make(map[string]string)
+	for n := 0; !strings.HasPrefix(rest, "]"); n++ {
+		if n > 0 {
+			if rest, ok = strings.CutPrefix(rest, ","); !ok {
+				return nil, errInvalidDerivation
+			}
+		}
+		if rest, ok = strings.CutPrefix(rest, "("); !ok {
+			return nil, errInvalidDerivation
+		}
+		// An output is the tuple (name, path, hash algorithm, hash)
+		var fields [4]string
+		for i := range fields {
+			if i > 0 {
+				if rest, ok = strings.CutPrefix(rest, ","); !ok {
+					return nil, errInvalidDerivation
+				}
+			}
+			var err error
+			if fields[i], rest, err = parseATermString(rest); err != nil {
+				return nil, err
+			}
+		}
+		if rest, ok = strings.CutPrefix(rest, ")"); !ok {
+			return nil, errInvalidDerivation
+		}
+		if fields[1] != "" {
+			outputs[fields[0]] = fields[1]
+		}
+	}
+	return outputs, nil
+}
+
+// parseATermString parses the quoted string at the start of s and returns it
+// unescaped along with the rest of s.
+func parseATermString(s string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", errInvalidDerivation
+	}
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return sb.String(), s[i+1:], nil
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", errInvalidDerivation
+			}
+			switch s[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			default:
+				sb.WriteByte(s[i])
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", "", errInvalidDerivation
+}
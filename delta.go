@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/simonfxr/nix-download/narextract"
+)
+
+// Experimental delta downloads (-experimental-delta with -base) reuse the
+// files of a similar path already in the store. Binary caches publish no
+// hashes of the files in a NAR, so a file of the base path is assumed to be
+// unchanged if it has the same name, size and executable bit as in the .ls
+// listing of the new path. All other byte ranges of the NAR are fetched with
+// Range requests and the assembled NAR is verified against the NarHash, if
+// the guess was wrong the NAR is downloaded in full.
+//
+// This only works for caches serving uncompressed NARs (Compression: none)
+// along with .ls listings and supporting Range requests, since offsets in a
+// compressed NAR cannot be mapped to the uncompressed one.
+
+var (
+	// deltaBase is the store path whose files are reused by delta downloads
+	deltaBase = ""
+	// deltaTargets are the base names of the paths given on the command
+	// line, only they are delta downloaded against deltaBase
+	deltaTargets = map[string]struct{}{}
+)
+
+// minDeltaFileSize is the size below which reusing a file is not worth an
+// additional Range request.
+const minDeltaFileSize = 64 * 1024
+
+// narSegment is a byte range of a NAR that is copied from a file of the base
+// path.
+type narSegment struct {
+	offset int64
+	size   int64
+	path   string
+}
+
+// fetchNarDelta assembles the NAR of sp from the files of deltaBase and Range
+// requests for the rest. The returned file is positioned at the start of the
+// verified NAR and removed once closed.
+func (d *Downloader) fetchNarDelta(sp StorePath) (*os.File, error) {
+	if sp.Compression != "none" {
+		return nil, fmt.Errorf("NAR is compressed with %s", sp.Compression)
+	}
+
+	root, err := d.fetchListing(sp)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []narSegment
+	var reused int64
+	basePath := filepath.Join(d.NixStore, deltaBase)
+	err = walkRegular(basePath, root, func(path string, entry *narextract.Entry) error {
+		if entry.Size < minDeltaFileSize {
+			return nil
+		}
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() || info.Size() != entry.Size || (info.Mode()&0100 != 0) != entry.Executable {
+			return nil
+		}
+		segments = append(segments, narSegment{offset: entry.NarOffset, size: entry.Size, path: path})
+		reused += entry.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, errors.New("no files of the base path can be reused")
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].offset < segments[j].offset })
+
+	f, err := os.CreateTemp("", ".nix-download_"+sp.BasePath+"-*.nar")
+	if err != nil {
+		return nil, err
+	}
+	// The file stays accessible through f until it is closed
+	os.Remove(f.Name())
+
+	narHasher := sha256.New()
+	w := io.MultiWriter(f, narHasher)
+	var offset int64
+	for _, seg := range segments {
+		if seg.offset < offset || seg.offset+seg.size > sp.NarSize {
+			f.Close()
+			return nil, errors.New("listing does not match the NAR")
+		}
+		if err := d.fetchNarRange(w, sp.NarURL, offset, seg.offset); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := copyFileTo(w, seg.path, seg.size); err != nil {
+			f.Close()
+			return nil, err
+		}
+		offset = seg.offset + seg.size
+	}
+	if err := d.fetchNarRange(w, sp.NarURL, offset, sp.NarSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	computedHash := "sha256:" + nixBase32Encode(narHasher.Sum(nil))
+	if computedHash != sp.NarHash {
+		f.Close()
+		return nil, fmt.Errorf("reused files differ from the new path (hash %s)", computedHash)
+	}
+	logf(1, "Delta download of %s reused %s from %s", sp.BasePath, formatSize(reused), deltaBase)
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// fetchListing fetches the .ls listing of sp from the substituter it was
+// found on.
+func (d *Downloader) fetchListing(sp StorePath) (*narextract.Entry, error) {
+	hash, _, _ := strings.Cut(sp.BasePath, "-")
+	lsURL, err := substituterURL(sp.Substituter, hash+".ls")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpGet(d.NarInfoClient, lsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{"listing", resp.Status}
+	}
+	var listing narextract.Listing
+	if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return nil, fmt.Errorf("invalid listing: %w", err)
+	}
+	if listing.Version != 1 || listing.Root == nil {
+		return nil, fmt.Errorf("unsupported listing version %d", listing.Version)
+	}
+	return listing.Root, nil
+}
+
+// fetchNarRange writes the bytes [start, end) of the NAR at narURL to w.
+func (d *Downloader) fetchNarRange(w io.Writer, narURL string, start, end int64) error {
+	if start == end {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(runCtx, http.MethodGet, narURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	resp, err := d.NarClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch NAR range: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("substituter does not support Range requests: %s", resp.Status)
+	}
+	n, err := io.Copy(w, io.LimitReader(resp.Body, end-start))
+	if err != nil {
+		return fmt.Errorf("failed to fetch NAR range: %w", err)
+	}
+	if n != end-start {
+		return fmt.Errorf("short NAR range: expected %d bytes, got %d", end-start, n)
+	}
+	return nil
+}
+
+func copyFileTo(w io.Writer, path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(w, io.LimitReader(f, size))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("%s changed while reading it", path)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/simonfxr/nix-download/narextract"
+)
+
+// Exit statuses for the classes of failures, a run failing for several
+// reasons exits with the status of the first failure.
+const (
+	exitFailure      = 1
+	exitVerification = 2
+	exitNetwork      = 3
+	exitHashMismatch = 4
+	exitDisk         = 5
+)
+
+var (
+	// errVerification wraps narinfos failing signature verification.
+	errVerification = errors.New("signature verification failed")
+	// errNarInfoIndex wraps narinfos not matching the -narinfo-index.
+	errNarInfoIndex = errors.New("narinfo index check failed")
+	// errHashMismatch wraps NARs whose contents do not match their narinfo.
+	errHashMismatch = errors.New("hash mismatch")
+)
+
+// httpStatusError is returned for unsuccessful HTTP responses.
+type httpStatusError struct {
+	what   string
+	status string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("failed to fetch %s: %s", e.what, e.status)
+}
+
+// exitCode returns the exit status for a run that failed with err.
+func exitCode(err error) int {
+	var urlErr *url.Error
+	var netErr net.Error
+	var statusErr *httpStatusError
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.Is(err, errVerification), errors.Is(err, errNarInfoIndex):
+		return exitVerification
+	case errors.Is(err, errHashMismatch), errors.Is(err, errTrailingData), errors.Is(err, errNarTooLarge), errors.Is(err, errNarTooShort), errors.Is(err, narextract.ErrNarTooLarge):
+		return exitHashMismatch
+	case errors.As(err, &urlErr), errors.As(err, &netErr), errors.As(err, &statusErr):
+		return exitNetwork
+	case errors.As(err, &pathErr), errors.As(err, &linkErr):
+		return exitDisk
+	default:
+		return exitFailure
+	}
+}
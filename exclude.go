@@ -0,0 +1,42 @@
+package main
+
+import "fmt"
+
+// excludedClosure are the narinfos of the closure of the -exclude-closure
+// paths, discovery treats them as present without looking at the store.
+var excludedClosure map[string]StorePath
+
+// discoverExcludedClosure fetches the narinfos of the closure of roots,
+// regardless of which paths are present, and stores them in
+// excludedClosure.
+func (d *Downloader) discoverExcludedClosure(roots []string) error {
+	excludedClosure = make(map[string]StorePath)
+	visited := make(map[string]struct{})
+	toVisit := roots
+	for len(toVisit) > 0 {
+		var level []string
+		for _, path := range toVisit {
+			if _, ok := visited[path]; ok {
+				continue
+			}
+			visited[path] = struct{}{}
+			level = append(level, path)
+		}
+		toVisit = nil
+
+		storePaths := make([]StorePath, len(level))
+		errs := make([]error, len(level))
+		parallelFor(len(level), discoveryJobs, func(i int) {
+			storePaths[i], errs[i] = d.fetchNarInfo(level[i])
+		})
+		for i, path := range level {
+			if errs[i] != nil {
+				return fmt.Errorf("error fetching narinfo for %s: %w", path, errs[i])
+			}
+			excludedClosure[path] = storePaths[i]
+			toVisit = append(toVisit, storePaths[i].References...)
+		}
+	}
+	logf(1, "Excluding the %d paths of the closure of -exclude-closure", len(excludedClosure))
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/simonfxr/nix-download/narextract"
+)
+
+// exportMagic follows the NAR of each path in the nix-store --export format.
+const exportMagic = 0x4558494e
+
+// exportWriter is stdout with -export, buffered since the format consists of
+// many small integers and strings.
+var exportWriter = bufio.NewWriterSize(os.Stdout, 64*1024)
+
+// fetchNarToFile fetches and decompresses the NAR of sp into a temporary file
+// and verifies its NarHash. The file is positioned at the start of the NAR.
+func (d *Downloader) fetchNarToFile(destPath string, sp StorePath) (*os.File, error) {
+	if offline && !isLocalURL(sp.NarURL) {
+		return nil, fmt.Errorf("offline: NAR %s requires a network fetch", sp.NarURL)
+	}
+
+	release, err := acquireNarMemory(sp)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resp, err := httpGet(d.NarClient, sp.NarURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch NAR: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{"NAR", resp.Status}
+	}
+
+	body, err := narBody(resp, sp)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(body, readBufferSize)
+	compression := narCompression(br, sp, servedNarMismatch(sp))
+	logf(2, "Decompressing %s with %s", sp.BasePath, compression)
+	reader, closeReader, err := decompress(br, compression)
+	if err != nil {
+		return nil, err
+	}
+	defer closeReader()
+
+	var limitedReader io.Reader = newNarSizeReader(reader, sp.NarSize)
+	if progress.w != nil {
+		limitedReader = &progressReader{r: limitedReader, path: destPath, total: sp.NarSize}
+	}
+
+	f, err := os.CreateTemp("", ".nix-download_"+sp.BasePath+"-*.nar")
+	if err != nil {
+		return nil, err
+	}
+	// The file stays accessible through f until it is closed
+	os.Remove(f.Name())
+
+	narHasher := sha256.New()
+	src := io.TeeReader(limitedReader, io.MultiWriter(f, narHasher))
+	if listingDir != "" {
+		listing, err := narextract.List(src)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to read NAR: %w", err)
+		}
+		if err := writeListing(sp, listing); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to write listing: %w", err)
+		}
+	}
+	if err := checkNarEnd(src, br); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to fetch NAR: %w", err)
+	}
+
+	computedHash := "sha256:" + nixBase32Encode(narHasher.Sum(nil))
+	if computedHash != sp.NarHash {
+		f.Close()
+		return nil, fmt.Errorf("%w: expected %s, got %s", errHashMismatch, sp.NarHash, computedHash)
+	}
+	logf(2, "Verified %s: %s", sp.BasePath, computedHash)
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeExport writes sp with its NAR read from nar to w in the format read
+// by nix-store --import. The stream must be ended with writeExportEnd.
+func writeExport(w io.Writer, sp StorePath, nar io.Reader) error {
+	start := time.Now()
+
+	references := make([]string, len(sp.References))
+	for i, ref := range sp.References {
+		references[i] = storeDir + "/" + ref
+	}
+	deriver := ""
+	if d, ok := sp.NarInfo["Deriver"]; ok && d != "unknown-deriver" {
+		deriver = storeDir + "/" + d
+	}
+
+	var buf []byte
+	buf = binary.LittleEndian.AppendUint64(buf, 1)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, nar); err != nil {
+		return err
+	}
+
+	buf = binary.LittleEndian.AppendUint64(buf[:0], exportMagic)
+	buf = appendExportString(buf, storeDir+"/"+sp.BasePath)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(references)))
+	for _, ref := range references {
+		buf = appendExportString(buf, ref)
+	}
+	buf = appendExportString(buf, deriver)
+	// The legacy signature is always omitted, narinfo signatures have no
+	// place in this format
+	buf = binary.LittleEndian.AppendUint64(buf, 0)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	logf(2, "Exported %s in %s", sp.BasePath, time.Since(start))
+	return nil
+}
+
+// writeExportEnd ends an export stream.
+func writeExportEnd(w io.Writer) error {
+	_, err := w.Write(binary.LittleEndian.AppendUint64(nil, 0))
+	return err
+}
+
+// appendExportString appends s in the length prefixed and zero padded string
+// encoding used by NARs and the export format.
+func appendExportString(buf []byte, s string) []byte {
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(s)))
+	buf = append(buf, s...)
+	return append(buf, make([]byte, (8-len(s)%8)%8)...)
+}
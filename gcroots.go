@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// gcRootsDir is where Nix looks for garbage collector roots, indirect roots
+// are symlinks in its auto subdirectory pointing to symlinks into the store.
+const gcRootsDir = "/nix/var/nix/gcroots"
+
+// gcRootDir is the -gc-root directory the symlinks to the requested paths
+// are created in.
+var gcRootDir = ""
+
+// initGCRoots creates the -gc-root directory and makes sure indirect roots
+// can be registered.
+func initGCRoots() error {
+	dir, err := filepath.Abs(gcRootDir)
+	if err != nil {
+		return err
+	}
+	gcRootDir = dir
+	autoDir := filepath.Join(gcRootsDir, "auto")
+	f, err := os.CreateTemp(autoDir, ".nix-download-probe-*")
+	if err != nil {
+		return fmt.Errorf("cannot register garbage collector roots in %s (%v), run as root or as the owner of the Nix store", autoDir, err)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return err
+	}
+	return os.MkdirAll(gcRootDir, 0755)
+}
+
+// addGCRoot protects the store path base from garbage collection like
+// nix-build does for its result links: <gc-root>/<base> points to the path
+// and is registered as an indirect root.
+func (d *Downloader) addGCRoot(base string) error {
+	link := filepath.Join(gcRootDir, base)
+	if err := replaceSymlink(filepath.Join(d.NixStore, base), link); err != nil {
+		return err
+	}
+	// Nix names indirect roots after the hash of the link
+	hash := sha1.Sum([]byte(link))
+	return replaceSymlink(link, filepath.Join(gcRootsDir, "auto", nixBase32Encode(hash[:])))
+}
+
+// replaceSymlink atomically makes path a symlink to target.
+func replaceSymlink(target, path string) error {
+	tmp := path + ".nix-download-tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// graphNode is a store path in the -print-graph json output.
+type graphNode struct {
+	Path string `json:"path"`
+	Name string `json:"name"`
+	// NarSize is omitted for paths already present, their narinfo is not
+	// fetched
+	NarSize    int64    `json:"narSize,omitempty"`
+	References []string `json:"references"`
+	Present    bool     `json:"present,omitempty"`
+}
+
+// closureGraph returns the nodes of the reference graph of cl, the paths to
+// download in topological order followed by the present ones.
+func closureGraph(cl closure) []graphNode {
+	nodes := make([]graphNode, 0, len(cl.StorePaths)+len(cl.Present))
+	for _, sp := range cl.StorePaths {
+		refs := make([]string, 0, len(sp.References))
+		for _, ref := range sp.References {
+			refs = append(refs, storeDir+"/"+ref)
+		}
+		nodes = append(nodes, graphNode{
+			Path:       storeDir + "/" + sp.BasePath,
+			Name:       storePathName(sp.BasePath),
+			NarSize:    sp.NarSize,
+			References: refs,
+		})
+	}
+	for _, base := range cl.Present {
+		nodes = append(nodes, graphNode{
+			Path:       storeDir + "/" + base,
+			Name:       storePathName(base),
+			References: []string{},
+			Present:    true,
+		})
+	}
+	return nodes
+}
+
+// storePathName returns the name part of a store path base name.
+func storePathName(base string) string {
+	_, name, _ := strings.Cut(base, "-")
+	return name
+}
+
+// printGraph writes the reference graph of cl to w in format, either dot or
+// json.
+func printGraph(w io.Writer, cl closure, format string) error {
+	nodes := closureGraph(cl)
+	switch format {
+	case "json":
+		data, err := json.Marshal(struct {
+			Nodes []graphNode `json:"nodes"`
+		}{nodes})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case "dot":
+		var buf strings.Builder
+		buf.WriteString("digraph closure {\n")
+		for _, node := range nodes {
+			label := node.Name
+			if node.Present {
+				label += "\\n(present)"
+			} else {
+				label += "\\n" + formatSize(node.NarSize)
+			}
+			fmt.Fprintf(&buf, "  %q [label=%q];\n", node.Path, label)
+		}
+		for _, node := range nodes {
+			for _, ref := range node.References {
+				if ref != node.Path {
+					fmt.Fprintf(&buf, "  %q -> %q;\n", node.Path, ref)
+				}
+			}
+		}
+		buf.WriteString("}\n")
+		_, err := io.WriteString(w, buf.String())
+		return err
+	default:
+		return fmt.Errorf("unsupported graph format: %s", format)
+	}
+}
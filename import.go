@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// importPath extracts the NAR in file, or stdin if file is "-", to the store
+// path base like a downloaded NAR, verifying it against the -hash flag, and
+// returns the exit status.
+func (d *Downloader) importPath(file, base string, opts *options) int {
+	if err := d.importNarFile(file, base, opts); err != nil {
+		log.Printf("Failed to import %s: %v", base, err)
+		return exitCode(err)
+	}
+	return 0
+}
+
+func (d *Downloader) importNarFile(file, base string, opts *options) error {
+	narHash, err := parseNarHash(opts.narHash)
+	if err != nil {
+		return err
+	}
+	compression := opts.compression
+	if compression == "" {
+		compression = "unknown"
+	} else if _, err := compressionExtension(compression); err != nil {
+		return err
+	}
+
+	destPath := filepath.Join(d.NixStore, base)
+	if intoDir != "" {
+		// The store is not touched, the directory is checked to be empty
+		// when extracting
+		destPath = intoDir
+	} else {
+		if d.pathOnDisk(base) {
+			logf(1, "%s is already present", destPath)
+			printPath(destPath, StorePath{BasePath: base})
+			return nil
+		}
+		if err := d.checkStoreWritable(); err != nil {
+			return err
+		}
+	}
+
+	var nar io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		nar = f
+	}
+
+	sp := StorePath{
+		BasePath:    base,
+		Compression: compression,
+		NarHash:     narHash,
+		NarSize:     unknownNarSize,
+	}
+	if opts.narSize >= 0 {
+		sp.NarSize = opts.narSize
+	}
+	if err := d.manifestNar(destPath, sp, nar, "", nil); err != nil {
+		return err
+	}
+	if postExtract != "" {
+		if err := runPostExtract(destPath); err != nil {
+			return fmt.Errorf("post-extract command failed: %w", err)
+		}
+	}
+	printPath(destPath, sp)
+	return nil
+}
+
+// parseNarHash returns the NAR hash given as sha256:<nix base32>,
+// sha256:<hex> or as an SRI hash sha256-<base64> in the sha256:<nix base32>
+// form of narinfos.
+func parseNarHash(s string) (string, error) {
+	var hash []byte
+	var err error
+	if encoded, ok := strings.CutPrefix(s, "sha256-"); ok {
+		hash, err = base64.StdEncoding.DecodeString(encoded)
+	} else if encoded, ok := strings.CutPrefix(s, "sha256:"); ok && len(encoded) == 64 {
+		hash, err = hex.DecodeString(encoded)
+	} else if ok {
+		hash, err = nixBase32Decode(encoded)
+	} else {
+		return "", fmt.Errorf("unsupported hash %q, expected sha256:<hash> or sha256-<base64>", s)
+	}
+	if err == nil && len(hash) != 32 {
+		err = fmt.Errorf("expected 32 bytes, got %d", len(hash))
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid hash %q: %w", s, err)
+	}
+	return "sha256:" + nixBase32Encode(hash), nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// maxXzDictSize bounds the LZMA2 dictionary of xz compressed NARs, it is the
+// dictionary size of the largest xz preset (-9). The xz package allocates the
+// dictionary declared by the stream, so a malicious stream could otherwise
+// make it allocate up to 4 GiB regardless of the NAR size.
+const maxXzDictSize = 64 * 1024 * 1024
+
+var xzMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+
+const (
+	xzStreamHeaderSize = 12
+	xzFilterLZMA2      = 0x21
+)
+
+// xzState is the part of an xz stream xzDictChecker expects next.
+type xzState int
+
+const (
+	xzStreamHeader xzState = iota
+	// xzBlockStart is the first byte of a block header, or the index
+	// indicator after the last block
+	xzBlockStart
+	xzBlockHeader
+	xzChunkControl
+	xzChunkHeader
+	// xzDone passes the rest of the stream, the index and footer, through
+	xzDone
+)
+
+// xzDictChecker passes an xz stream through and fails before handing out
+// the header of any block declaring an LZMA2 dictionary larger than
+// maxXzDictSize. The xz package allocates the dictionary of each block as it
+// starts, so every block is checked. The blocks are found by following the
+// LZMA2 chunk headers, which carry their compressed sizes, without
+// decompressing anything.
+type xzDictChecker struct {
+	r     io.Reader
+	err   error
+	state xzState
+	// buf collects the need bytes of the header expected in state
+	buf  []byte
+	need int
+	// skip is the number of bytes to pass before the next header
+	skip int64
+	// blockSize counts the bytes of the current block for its padding
+	blockSize int64
+	checkSize int64
+	control   byte
+}
+
+func newXzDictChecker(r io.Reader) *xzDictChecker {
+	return &xzDictChecker{r: r, state: xzStreamHeader, need: xzStreamHeaderSize}
+}
+
+func (c *xzDictChecker) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.r.Read(p)
+	// The xz package reads the compressed data byte by byte, most of which
+	// is within chunks
+	if int64(n) <= c.skip {
+		c.skip -= int64(n)
+	} else if c.state != xzDone {
+		if err := c.process(p[:n]); err != nil {
+			c.err = err
+			return 0, err
+		}
+	}
+	return n, err
+}
+
+// expect makes the next need bytes the header expected in state.
+func (c *xzDictChecker) expect(state xzState, need int) {
+	c.state = state
+	c.need = need
+	c.buf = c.buf[:0]
+}
+
+func (c *xzDictChecker) process(p []byte) error {
+	for len(p) > 0 && c.state != xzDone {
+		if c.skip > 0 {
+			n := min(int64(len(p)), c.skip)
+			c.skip -= n
+			p = p[n:]
+			continue
+		}
+		n := min(len(p), c.need-len(c.buf))
+		c.buf = append(c.buf, p[:n]...)
+		p = p[n:]
+		if len(c.buf) < c.need {
+			continue
+		}
+		if err := c.handle(c.buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handle processes the complete header buf expected in c.state.
+func (c *xzDictChecker) handle(buf []byte) error {
+	switch c.state {
+	case xzStreamHeader:
+		if !bytes.Equal(buf[:len(xzMagic)], xzMagic) {
+			// Let the xz reader report the invalid stream
+			c.state = xzDone
+			return nil
+		}
+		if checkType := buf[7] & 0x0f; checkType != 0 {
+			c.checkSize = 4 << ((checkType - 1) / 3)
+		}
+		c.expect(xzBlockStart, 1)
+	case xzBlockStart:
+		if buf[0] == 0 {
+			c.state = xzDone
+			return nil
+		}
+		headerSize := (int(buf[0]) + 1) * 4
+		c.blockSize = int64(headerSize)
+		c.expect(xzBlockHeader, headerSize-1)
+	case xzBlockHeader:
+		if err := checkXzBlockHeader(buf); err != nil {
+			return err
+		}
+		c.expect(xzChunkControl, 1)
+	case xzChunkControl:
+		c.blockSize++
+		c.control = buf[0]
+		switch {
+		case c.control == 0:
+			// The end of the block, its padding and check follow
+			c.skip = (4-c.blockSize%4)%4 + c.checkSize
+			c.expect(xzBlockStart, 1)
+		case c.control <= 2:
+			c.expect(xzChunkHeader, 2)
+		case c.control >= 0xc0:
+			// Chunks resetting the state carry the LZMA properties
+			c.expect(xzChunkHeader, 5)
+		case c.control >= 0x80:
+			c.expect(xzChunkHeader, 4)
+		default:
+			return errors.New("xz: invalid LZMA2 chunk")
+		}
+	case xzChunkHeader:
+		sizeBytes := buf[:2]
+		if c.control >= 0x80 {
+			sizeBytes = buf[2:4]
+		}
+		size := int64(sizeBytes[0])<<8 | int64(sizeBytes[1]) + 1
+		c.blockSize += int64(len(buf)) + size
+		c.skip = size
+		c.expect(xzChunkControl, 1)
+	}
+	return nil
+}
+
+// checkXzBlockHeader fails if the xz block header block, without its size
+// byte, declares an LZMA2 dictionary larger than maxXzDictSize.
+func checkXzBlockHeader(block []byte) error {
+	flags := block[0]
+	block = block[1:]
+	numFilters := int(flags&0x03) + 1
+	var err error
+	for _, present := range []bool{flags&0x40 != 0, flags&0x80 != 0} {
+		if present {
+			if _, block, err = readXzVarint(block); err != nil {
+				return err
+			}
+		}
+	}
+
+	for range numFilters {
+		var id, propsSize uint64
+		if id, block, err = readXzVarint(block); err != nil {
+			return err
+		}
+		if propsSize, block, err = readXzVarint(block); err != nil {
+			return err
+		}
+		if propsSize > uint64(len(block)) {
+			return errors.New("xz: invalid block header")
+		}
+		props := block[:propsSize]
+		block = block[propsSize:]
+		if id != xzFilterLZMA2 || len(props) != 1 {
+			continue
+		}
+		dictSize, err := lzma.DecodeDictCap(props[0])
+		if err != nil {
+			return fmt.Errorf("xz: %w", err)
+		}
+		if dictSize > maxXzDictSize {
+			return fmt.Errorf("xz dictionary size of %d bytes exceeds the maximum of %d bytes", dictSize, maxXzDictSize)
+		}
+	}
+	return nil
+}
+
+// readXzVarint decodes a multibyte integer of the xz format at the start of
+// data and returns the remaining data.
+func readXzVarint(data []byte) (uint64, []byte, error) {
+	var n uint64
+	for i := 0; i < len(data) && i < 9; i++ {
+		n |= uint64(data[i]&0x7f) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return n, data[i+1:], nil
+		}
+	}
+	return 0, nil, errors.New("xz: invalid block header")
+}
+
+// errTrailingData is returned if the compressed NAR continues after the end
+// of the compressed stream.
+var errTrailingData = errors.New("trailing data after NAR")
+
+// checkNarEnd reads nar, the decompressed NAR, to its end and makes sure that
+// nothing follows the compressed stream in body. Reading past the end of the
+// NAR makes narSizeReader fail on excess data and the decompressor fail on
+// corrupt input after a valid stream.
+func checkNarEnd(nar, body io.Reader) error {
+	if _, err := io.Copy(io.Discard, nar); err != nil {
+		return err
+	}
+	n, err := io.Copy(io.Discard, body)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%w: %d bytes", errTrailingData, n)
+	}
+	return nil
+}
+
+// errNarTooLarge is returned when a decompressed NAR is longer than its
+// narinfo's NarSize.
+var errNarTooLarge = errors.New("decompressed NAR exceeds NarSize")
+
+// errNarTooShort is returned when a decompressed NAR ends before its
+// narinfo's NarSize, i.e. it was truncated.
+var errNarTooShort = errors.New("decompressed NAR is shorter than NarSize")
+
+// unknownNarSize is the NarSize of NARs whose size is not known, such as
+// imported ones without -nar-size. They are not checked to be of that size.
+const unknownNarSize = math.MaxInt64
+
+// narSizeReader reads at most n bytes of a decompressed NAR like
+// io.LimitReader, but fails with errNarTooLarge instead of ending the stream
+// if there is more data, and with errNarTooShort if there is less.
+type narSizeReader struct {
+	r    io.Reader
+	n    int64
+	size int64
+}
+
+func newNarSizeReader(r io.Reader, narSize int64) *narSizeReader {
+	return &narSizeReader{r: r, n: narSize, size: narSize}
+}
+
+func (nr *narSizeReader) Read(p []byte) (int, error) {
+	if nr.n <= 0 {
+		var probe [1]byte
+		n, err := nr.r.Read(probe[:])
+		if n > 0 {
+			return 0, errNarTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > nr.n {
+		p = p[:nr.n]
+	}
+	n, err := nr.r.Read(p)
+	nr.n -= int64(n)
+	// Readers like gzip may return the last bytes together with io.EOF
+	if err == io.EOF && nr.n > 0 && nr.size != unknownNarSize {
+		err = fmt.Errorf("%w: expected %d bytes, got %d", errNarTooShort, nr.size, nr.size-nr.n)
+	}
+	return n, err
+}
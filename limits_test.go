@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/ulikunitz/xz"
+)
+
+// xzBlock is a block of a hand made xz stream, data is stored in
+// uncompressed LZMA2 chunks and dictProp encodes the declared dictionary.
+type xzBlock struct {
+	dictProp byte
+	data     []byte
+}
+
+// appendXzVarint appends n as a multibyte integer of the xz format.
+func appendXzVarint(b []byte, n uint64) []byte {
+	for n >= 0x80 {
+		b = append(b, byte(n)|0x80)
+		n >>= 7
+	}
+	return append(b, byte(n))
+}
+
+func appendCRC32(b []byte, data []byte) []byte {
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(data))
+}
+
+// makeXzStream builds an xz stream without integrity check from blocks.
+func makeXzStream(blocks ...xzBlock) []byte {
+	flags := []byte{0, 0}
+	stream := appendCRC32(append(append([]byte{}, xzMagic...), flags...), flags)
+
+	index := []byte{0}
+	index = appendXzVarint(index, uint64(len(blocks)))
+	for _, b := range blocks {
+		// Header size, no flags, one LZMA2 filter with its dictionary size
+		header := []byte{2, 0, xzFilterLZMA2, 1, b.dictProp, 0, 0, 0}
+		header = appendCRC32(header, header)
+		block := header
+		for i := 0; i < len(b.data); i += 1 << 16 {
+			chunk := b.data[i:min(i+1<<16, len(b.data))]
+			control := byte(2)
+			if i == 0 {
+				control = 1
+			}
+			block = append(block, control, byte((len(chunk)-1)>>8), byte(len(chunk)-1))
+			block = append(block, chunk...)
+		}
+		block = append(block, 0)
+		unpadded := len(block)
+		for len(block)%4 != 0 {
+			block = append(block, 0)
+		}
+		stream = append(stream, block...)
+		index = appendXzVarint(index, uint64(unpadded))
+		index = appendXzVarint(index, uint64(len(b.data)))
+	}
+	for len(index)%4 != 0 {
+		index = append(index, 0)
+	}
+	index = appendCRC32(index, index)
+	stream = append(stream, index...)
+
+	footer := binary.LittleEndian.AppendUint32(nil, uint32(len(index)/4-1))
+	footer = append(footer, flags...)
+	stream = appendCRC32(stream, footer)
+	return append(append(stream, footer...), 'Y', 'Z')
+}
+
+func decompressAll(t *testing.T, stream []byte, compression string) ([]byte, error) {
+	t.Helper()
+	r, closeReader, err := decompress(bytes.NewReader(stream), compression)
+	if err != nil {
+		return nil, err
+	}
+	defer closeReader()
+	return io.ReadAll(r)
+}
+
+func TestXzDictCheckerAcceptsSmallDictionaries(t *testing.T) {
+	first := bytes.Repeat([]byte("first block "), 10000)
+	second := bytes.Repeat([]byte("second block "), 100)
+	stream := makeXzStream(xzBlock{dictProp: 0, data: first}, xzBlock{dictProp: 16, data: second})
+	got, err := decompressAll(t, stream, "xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(first, second...); !bytes.Equal(got, want) {
+		t.Fatalf("decompressed %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestXzDictCheckerRejectsLargeDictionaryInLaterBlock(t *testing.T) {
+	// The first block is harmless, the second one declares 4 GiB
+	stream := makeXzStream(xzBlock{dictProp: 0, data: []byte("small")}, xzBlock{dictProp: 40, data: []byte("large")})
+	_, err := decompressAll(t, stream, "xz")
+	if err == nil || !strings.Contains(err.Error(), "dictionary size") {
+		t.Fatalf("got error %v, want a dictionary size error", err)
+	}
+}
+
+func TestXzDictCheckerRejectsLargeDictionaryInFirstBlock(t *testing.T) {
+	stream := makeXzStream(xzBlock{dictProp: 40, data: []byte("large")})
+	_, err := decompressAll(t, stream, "xz")
+	if err == nil || !strings.Contains(err.Error(), "dictionary size") {
+		t.Fatalf("got error %v, want a dictionary size error", err)
+	}
+}
+
+// TestXzDictCheckerFollowsLZMAChunks checks the checker against streams of
+// the xz package, whose blocks consist of compressed LZMA2 chunks.
+func TestXzDictCheckerFollowsLZMAChunks(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, 1<<20)
+	for i := range data {
+		// Compressible, but not so much that the chunks stay tiny
+		data[i] = "abcdefgh"[rng.Intn(8)]
+	}
+	for _, check := range []byte{xz.None, xz.CRC32, xz.CRC64, xz.SHA256} {
+		var buf bytes.Buffer
+		w, err := xz.WriterConfig{BlockSize: 100 << 10, CheckSum: check}.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := decompressAll(t, buf.Bytes(), "xz")
+		if err != nil {
+			t.Fatalf("check %d: %v", check, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("check %d: decompressed data differs", check)
+		}
+	}
+}
+
+func TestNarSizeReader(t *testing.T) {
+	data := bytes.Repeat([]byte("nar"), 1000)
+	stream := makeXzStream(xzBlock{data: data})
+	for _, tc := range []struct {
+		narSize int64
+		want    error
+	}{
+		{int64(len(data)), nil},
+		{10, errNarTooLarge},
+		{int64(len(data)) + 1, errNarTooShort},
+	} {
+		r, closeReader, err := decompress(bytes.NewReader(stream), "xz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(newNarSizeReader(r, tc.narSize))
+		closeReader()
+		if !errors.Is(err, tc.want) && !(tc.want == nil && err == nil) {
+			t.Errorf("NarSize %d: got error %v, want %v", tc.narSize, err, tc.want)
+		}
+		if int64(len(got)) > tc.narSize {
+			t.Errorf("NarSize %d: read %d bytes", tc.narSize, len(got))
+		}
+		if exitCode(err) != exitHashMismatch && tc.want != nil {
+			t.Errorf("NarSize %d: exit status %d, want %d", tc.narSize, exitCode(err), exitHashMismatch)
+		}
+	}
+}
+
+func TestNarSizeReaderAcceptsEOFWithLastBytes(t *testing.T) {
+	data := []byte("nar")
+	got, err := io.ReadAll(newNarSizeReader(iotest.DataErrReader(bytes.NewReader(data)), int64(len(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %q, want %q", got, data)
+	}
+}
@@ -2,18 +2,25 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
 	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/base64"
-	"flag"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"sort"
 	"strconv"
@@ -28,58 +35,147 @@ import (
 )
 
 var (
-	nixStore     = ""
-	substituters = []string{}
-	knownKeys    = map[string]ed25519.PublicKey{}
-	transport    = func() http.RoundTripper {
+	storeDir     = "/nix/store"
+	signingKey   *secretKey
+	listingDir   = ""
+	dryRun       = false
+	offline      = false
+	jsonOutput   = false
+	verbosity    = 0
+	quiet        = false
+	pathsFile    = ""
+	withPresent  = false
+	printMissing = false
+	// printGraphFormat is the format of the -print-graph output, if given
+	printGraphFormat = ""
+	// closureSize only prints the size of the closure, including present paths
+	closureSize = false
+	// discoverOnly only prints the plan of the paths to download
+	discoverOnly = false
+	// paranoid checks present paths against their narinfo
+	paranoid = false
+	// downloadOnlyDir is the binary cache NARs are stored in by -download-only
+	downloadOnlyDir = ""
+	// useDaemon imports paths with the nix-daemon instead of writing them
+	useDaemon = false
+	// exportNars writes the paths to stdout in the nix-store --import format
+	exportNars = false
+	// intoDir is the existing empty directory import extracts to with -into
+	intoDir = ""
+	// metricsFile is the Prometheus textfile written after the run
+	metricsFile = ""
+	// keepNarDir keeps a copy of the compressed NARs of extracted paths
+	keepNarDir = ""
+	// optimise hard links identical files across the downloaded paths
+	optimise    = false
+	keepGoing   = false
+	postExtract = ""
+	// preferredCompressions lists compression types in order of preference
+	preferredCompressions []string
+	// allowedCompressions restricts the compression types downloaded, if set
+	allowedCompressions []string
+	// jobs bounds the number of concurrent NAR downloads
+	jobs = 8
+	// discoveryJobs bounds the number of concurrent narinfo fetches, the
+	// narinfo slots of each substituter apply in addition
+	discoveryJobs = 32
+	// readBufferSize is the size of the buffer NAR downloads are read
+	// through
+	readBufferSize = 64 * 1024
+	transport      = func() http.RoundTripper {
 		t := http.DefaultTransport.(*http.Transport).Clone()
 		t.ResponseHeaderTimeout = 30 * time.Second
+		// Keep the connections of concurrent narinfo queries for reuse
+		t.MaxIdleConnsPerHost = massQueryJobs
+		t.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
 		return t
 	}()
-	narInfoClient = http.Client{
-		Transport: transport,
-		Timeout:   30 * time.Second,
-	}
-	narClient = http.Client{
-		Transport: transport,
-		Timeout:   10 * time.Minute,
-	}
+	// narTransport does not request compressed responses, which the
+	// transport would decompress transparently, see narBody
+	narTransport = func() http.RoundTripper {
+		t := transport.(*http.Transport).Clone()
+		t.DisableCompression = true
+		// Clone does not copy registered protocols
+		t.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+		return t
+	}()
+	// runCtx is cancelled when the -deadline expires, all requests are bound
+	// to it
+	runCtx = context.Background()
 )
 
-type StorePath struct {
-	BasePath    string
-	References  []string
-	NarURL      string
-	Compression string
-	NarSize     int64
-	NarHash     string // Add this field
+// Downloader fetches store paths from a set of substituters into a store.
+type Downloader struct {
+	// NixStore is the absolute directory the store paths are written to
+	NixStore string
+	// Substituters lists the normalized binary cache URLs in the order they
+	// are tried
+	Substituters []string
+	// KnownKeys maps the names of the trusted keys to their public keys
+	KnownKeys map[string]ed25519.PublicKey
+	// AllowUnsigned lists the substituters whose narinfos are trusted
+	// without a signature
+	AllowUnsigned []string
+	// NarInfoClient is used for narinfos and other small files, NarClient for
+	// NARs
+	NarInfoClient, NarClient *http.Client
 }
 
-func main() {
-	var publicKeys stringSliceFlag
-
-	flag.StringVar(&nixStore, "store", "/nix/store", "Nix store root directory")
-	flag.Var((*stringSliceFlag)(&substituters), "substituter", "URL of a binary cache (can be specified multiple times)")
-	flag.Var(&publicKeys, "public-key", "Public key in the format name:base64pubkey (can be specified multiple times)")
+// newDownloader validates the store, substituter and key flags and returns a
+// Downloader for them. It makes no requests, see probeSubstituters.
+func newDownloader(opts *options) *Downloader {
+	d := &Downloader{
+		KnownKeys: map[string]ed25519.PublicKey{},
+		NarInfoClient: &http.Client{
+			Transport:     transport,
+			Timeout:       30 * time.Second,
+			CheckRedirect: checkRedirect,
+		},
+		NarClient: &http.Client{
+			Transport:     narTransport,
+			Timeout:       10 * time.Minute,
+			CheckRedirect: checkRedirect,
+		},
+	}
 
-	flag.Parse()
+	if len(opts.substituters) == 0 {
+		opts.substituters = append(opts.substituters, defaultSubstituter)
+	}
+	for _, substituter := range opts.substituters {
+		normalized, err := normalizeSubstituter(substituter)
+		if err != nil {
+			log.Fatalf("Invalid substituter %s: %v", substituter, err)
+		}
+		d.Substituters = append(d.Substituters, normalized)
+	}
 
-	if len(substituters) == 0 {
-		substituters = append(substituters, "https://cache.nixos.org")
+	for _, substituter := range opts.allowUnsignedFrom {
+		normalized, err := normalizeSubstituter(substituter)
+		if err != nil {
+			log.Fatalf("Invalid -allow-unsigned-from substituter %s: %v", substituter, err)
+		}
+		if !slices.Contains(d.Substituters, normalized) {
+			log.Fatalf("-allow-unsigned-from %s is not one of the -substituter URLs", substituter)
+		}
+		d.AllowUnsigned = append(d.AllowUnsigned, normalized)
 	}
 
-	if len(publicKeys) == 0 {
-		publicKeys = append(publicKeys, "cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY=")
+	if len(opts.publicKeys) == 0 {
+		opts.publicKeys = append(opts.publicKeys, defaultPublicKey)
 	}
 
-	err := error(nil)
-	nixStore, err = filepath.Abs(nixStore)
+	var err error
+	d.NixStore, err = filepath.Abs(opts.store)
 	if err != nil {
 		log.Fatalf("Bad nix store path: %v", err)
 	}
 
+	if !filepath.IsAbs(storeDir) || filepath.Clean(storeDir) != storeDir {
+		log.Fatalf("Store dir must be a clean absolute path: %s", storeDir)
+	}
+
 	// Process public keys
-	for _, keyPair := range publicKeys {
+	for _, keyPair := range opts.publicKeys {
 		parts := strings.SplitN(keyPair, ":", 2)
 		if len(parts) != 2 {
 			log.Fatalf("Invalid public key format: %s", keyPair)
@@ -92,112 +188,1021 @@ func main() {
 		if len(pubKey) != ed25519.PublicKeySize {
 			log.Fatalf("Invalid public key: %s", keyPair)
 		}
-		knownKeys[name] = ed25519.PublicKey(pubKey)
+		d.KnownKeys[name] = ed25519.PublicKey(pubKey)
+	}
+	return d
+}
+
+type StorePath struct {
+	BasePath string
+	// References are the sorted base names of the referenced paths, checked
+	// by newStorePath like the roots by storePathBase, so they can be
+	// compared with the visited base names of discovery. A self-reference is
+	// BasePath itself. Narinfos written by nix-download use the References
+	// field of NarInfo, which keeps the order of the original narinfo.
+	References  []string
+	NarURL      string
+	Compression string
+	NarSize     int64
+	FileSize    int64
+	NarHash     string // Add this field
+	Substituter string
+	// NarInfo holds the narinfo fields except for the signatures
+	NarInfo map[string]string
+	Sigs    []string
+}
+
+// pathResult is the -json output for a single path.
+type pathResult struct {
+	Path        string `json:"path"`
+	Substituter string `json:"substituter"`
+}
+
+// The substituter and its key used unless -substituter and -public-key are
+// given.
+const (
+	defaultSubstituter = "https://cache.nixos.org"
+	defaultPublicKey   = "cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="
+)
+
+// options holds the flags that are only needed while setting up a run.
+type options struct {
+	store string
+	// name and printPath are the -name and -print-path flags of prefetch
+	name      string
+	printPath bool
+	// narHash, narSize and compression describe the NAR of import
+	narHash           string
+	narSize           int64
+	compression       string
+	substituters      stringSliceFlag
+	allowUnsignedFrom stringSliceFlag
+	publicKeys        stringSliceFlag
+	secretKeyFile     string
+	preferCompression string
+	allowCompression  string
+	experimentalDelta bool
+	deadline          time.Duration
+	stateFile         string
+	showVersion       bool
+	checkClosure      bool
+	progressFd        int
+	planFile          string
+	narInfoIndexFile  string
+	maxMemory         string
+	readBufferSize    string
+	zstdDicts         stringSliceFlag
+	refFilters        stringSliceFlag
+	excludeClosure    stringSliceFlag
+}
+
+func main() {
+	// Without a command the arguments are those of download
+	name, args := "download", os.Args[1:]
+	if len(args) > 0 && isCommand(args[0]) {
+		name, args = args[0], args[1:]
+	}
+
+	var opts options
+	fs := newFlagSet(name, &opts)
+	fs.Parse(args)
+
+	switch name {
+	case "version":
+		printVersion()
+		return
+	case "completion":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(exitFailure)
+		}
+		if err := printCompletion(os.Stdout, fs.Arg(0), opts.store, newFlagSet("download", &options{})); err != nil {
+			log.Fatalf("Failed to generate completion: %v", err)
+		}
+		return
+	case "copy":
+		if downloadOnlyDir == "" {
+			log.Fatalf("copy requires -to")
+		}
+	case "pack":
+		exportNars = true
+	case "import":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			os.Exit(exitFailure)
+		}
+		if opts.narHash == "" {
+			log.Fatalf("import requires -hash")
+		}
+		if intoDir != "" && optimise {
+			log.Fatalf("-into cannot be combined with -optimise")
+		}
+	case "list":
+		if !printMissing && !closureSize && printGraphFormat == "" && !discoverOnly {
+			dryRun = true
+		}
 	}
 
-	// Get all non-flag arguments as paths to download
-	for _, path := range flag.Args() {
+	if opts.showVersion {
+		printVersion()
+		return
+	}
 
-		// Phase 1: Discovery
-		storePaths, err := discoverDependencies(path)
-		if err != nil {
-			log.Printf("Error during discovery for %s: %v", path, err)
+	if fs.NArg() == 0 && opts.planFile == "" {
+		fs.Usage()
+		os.Exit(exitFailure)
+	}
+
+	d := newDownloader(&opts)
+
+	// Reject malformed paths before any request is made
+	paths := make([]string, fs.NArg())
+	for i, arg := range fs.Args() {
+		if name == "prefetch" && isURL(arg) || name == "import" && i == 0 {
+			paths[i] = arg
 			continue
 		}
+		base, err := d.storePathBase(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		paths[i] = base
+	}
+
+	if opts.deadline > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(context.Background(), opts.deadline)
+		defer cancel()
+	}
+
+	// Imported NARs are not fetched from the substituters
+	if name != "import" {
+		d.probeSubstituters()
+	}
+	setup(d, &opts)
+
+	var status int
+	switch name {
+	case "verify":
+		status = d.verifyPaths(paths)
+	case "import":
+		status = d.importPath(paths[0], paths[1], &opts)
+	case "prefetch":
+		status = d.prefetchPaths(paths, &opts)
+	case "narinfo":
+		status = d.printNarInfos(paths)
+	case "log":
+		status = d.printBuildLogs(paths)
+	default:
+		status = d.download(paths, &opts)
+	}
+	if status != 0 {
+		os.Exit(status)
+	}
+}
+
+// setup validates the remaining flags and initializes the globals derived
+// from them.
+func setup(d *Downloader, opts *options) {
+	if opts.preferCompression != "" {
+		for _, c := range strings.Split(opts.preferCompression, ",") {
+			if !slices.Contains(supportedCompressions, c) {
+				log.Fatalf("Unsupported compression type: %s", c)
+			}
+			preferredCompressions = append(preferredCompressions, c)
+		}
+	}
+
+	if opts.allowCompression != "" {
+		for _, c := range strings.Split(opts.allowCompression, ",") {
+			if !slices.Contains(supportedCompressions, c) {
+				log.Fatalf("Unsupported compression type: %s", c)
+			}
+			allowedCompressions = append(allowedCompressions, c)
+		}
+	}
+
+	if deltaBase != "" && !opts.experimentalDelta {
+		log.Fatalf("-base requires -experimental-delta")
+	}
+	if opts.experimentalDelta && deltaBase == "" {
+		log.Fatalf("-experimental-delta requires -base")
+	}
+	if deltaBase != "" {
+		base, err := d.storePathBase(deltaBase)
+		if err != nil {
+			log.Fatalf("Invalid -base: %v", err)
+		}
+		deltaBase = base
+	}
+
+	if jobs < 1 {
+		log.Fatalf("-jobs must be at least 1")
+	}
+	if discoveryJobs < 1 {
+		log.Fatalf("-discovery-jobs must be at least 1")
+	}
+	if parallelRoots < 0 {
+		log.Fatalf("-parallel-roots must not be negative")
+	}
+	if parallelRoots > 0 {
+		if useDaemon || exportNars || opts.planFile != "" {
+			log.Fatalf("-parallel-roots cannot be combined with -use-daemon, -export or -from-plan")
+		}
+		jobSlots = make(chan struct{}, jobs)
+	}
+
+	if printGraphFormat != "" && printGraphFormat != "dot" && printGraphFormat != "json" {
+		log.Fatalf("Unsupported graph format: %s", printGraphFormat)
+	}
+
+	if useDaemon && downloadOnlyDir != "" {
+		log.Fatalf("-use-daemon and -download-only cannot be combined")
+	}
+
+	if exportNars && (useDaemon || downloadOnlyDir != "") {
+		log.Fatalf("-export cannot be combined with -use-daemon or -download-only")
+	}
+
+	if gcRootDir != "" {
+		if downloadOnlyDir != "" || useDaemon || exportNars {
+			log.Fatalf("-gc-root cannot be combined with -download-only, -use-daemon or -export")
+		}
+		if err := initGCRoots(); err != nil {
+			log.Fatalf("Failed to set up -gc-root: %v", err)
+		}
+	}
+
+	if keepNarDir != "" {
+		if err := os.MkdirAll(keepNarDir, 0755); err != nil {
+			log.Fatalf("Failed to create -keep-nar directory: %v", err)
+		}
+	}
+
+	if downloadOnlyDir != "" {
+		if err := initBinaryCacheDir(downloadOnlyDir); err != nil {
+			log.Fatalf("Failed to create binary cache directory: %v", err)
+		}
+	}
+
+	if opts.narInfoIndexFile != "" {
+		if opts.planFile != "" {
+			log.Fatalf("-narinfo-index cannot be combined with -from-plan")
+		}
+		if err := loadNarInfoIndex(opts.narInfoIndexFile); err != nil {
+			log.Fatalf("Failed to load narinfo index: %v", err)
+		}
+	}
+
+	if opts.maxMemory != "" {
+		limit, err := parseSize(opts.maxMemory)
+		if err != nil {
+			log.Fatalf("Invalid -max-memory: %v", err)
+		}
+		narMemory.limit = limit
+	}
+
+	if opts.readBufferSize != "" {
+		size, err := parseSize(opts.readBufferSize)
+		if err != nil {
+			log.Fatalf("Invalid -read-buffer-size: %v", err)
+		}
+		if size < minReadBufferSize {
+			log.Fatalf("-read-buffer-size must be at least %dK", minReadBufferSize/1024)
+		}
+		readBufferSize = int(size)
+	}
+
+	for _, s := range opts.refFilters {
+		f, err := parseRefFilter(s)
+		if err != nil {
+			log.Fatalf("Invalid -ref-filter: %v", err)
+		}
+		refFilters = append(refFilters, f)
+	}
+	for i, path := range opts.excludeClosure {
+		base, err := d.storePathBase(path)
+		if err != nil {
+			log.Fatalf("Invalid -exclude-closure: %v", err)
+		}
+		opts.excludeClosure[i] = base
+	}
+	if len(opts.excludeClosure) > 0 && opts.planFile != "" {
+		log.Fatalf("-exclude-closure cannot be combined with -from-plan")
+	}
+	if perSubstituterJobs < 0 {
+		log.Fatalf("-per-substituter-jobs must not be negative")
+	}
+	if withDebug && opts.planFile != "" {
+		log.Fatalf("-with-debug cannot be combined with -from-plan")
+	}
+
+	if len(refFilters) > 0 {
+		log.Printf("Warning: -ref-filter skips references, the closure will be incomplete")
+	}
+
+	for _, file := range opts.zstdDicts {
+		if err := loadZstdDict(file); err != nil {
+			log.Fatalf("Failed to load -zstd-dict: %v", err)
+		}
+	}
+
+	if opts.stateFile != "" {
+		if err := d.loadState(opts.stateFile); err != nil {
+			log.Fatalf("Failed to load state: %v", err)
+		}
+	}
+
+	if opts.progressFd >= 0 {
+		f := os.NewFile(uintptr(opts.progressFd), "progress-fd")
+		if f == nil {
+			log.Fatalf("Invalid progress fd: %d", opts.progressFd)
+		}
+		progress.w = f
+	}
+
+	if opts.secretKeyFile != "" {
+		sk, err := loadSecretKey(opts.secretKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load secret key: %v", err)
+		}
+		signingKey = &sk
+	}
+}
+
+// download fetches the closures of paths and returns the exit status.
+func (d *Downloader) download(paths []string, opts *options) int {
+	for _, base := range paths {
+		deltaTargets[base] = struct{}{}
+	}
+
+	if !dryRun && !printMissing && !closureSize && printGraphFormat == "" && !discoverOnly && downloadOnlyDir == "" && !useDaemon && !exportNars {
+		if err := d.checkStoreWritable(); err != nil {
+			log.Printf("Store is not writable: %v", err)
+			os.Exit(exitDisk)
+		}
+	}
+
+	var written []string
+	var skipped []string
+	skippedSet := make(map[string]struct{})
+	// status is the exit status of the first failure
+	status := 0
+	// mu guards the results of the roots processed at the same time with
+	// -parallel-roots
+	var mu sync.Mutex
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if status == 0 {
+			status = exitCode(err)
+		}
+	}
+	// incomplete are the paths not downloaded when the deadline expired
+	var incomplete []string
+	var metrics runMetrics
+
+	// fetchClosure downloads the discovered closure cl of roots
+	fetchClosure := func(cl closure, roots []string) {
+		if opts.checkClosure {
+			if err := checkClosureComplete(cl); err != nil {
+				log.Printf("Incomplete closure: %v", err)
+				fail(err)
+				return
+			}
+		}
 
 		// Phase 2 & 3: Fetching and Manifestation
-		err = fetchAndManifestStorePaths(storePaths)
+		done, err := d.fetchAndManifestStorePaths(cl.StorePaths)
+		logf(1, "Downloaded %d of %d paths, %d already present", len(done), len(cl.StorePaths), len(cl.Present))
+		if err != nil {
+			log.Printf("Error during fetching and manifestation: %v", err)
+			fail(err)
+		}
+
+		mu.Lock()
+		failed := 0
+		for _, base := range cl.Skipped {
+			// Roots processed on their own can skip the same dependency
+			if _, ok := skippedSet[base]; !ok {
+				skippedSet[base] = struct{}{}
+				skipped = append(skipped, base)
+				failed++
+			}
+		}
+		if withPresent {
+			for _, base := range cl.Present {
+				written = append(written, storeDir+"/"+base)
+			}
+		}
+		downloaded := make(map[string]struct{}, len(done))
+		for _, sp := range done {
+			written = append(written, storeDir+"/"+sp.BasePath)
+			downloaded[sp.BasePath] = struct{}{}
+		}
+		for _, sp := range cl.StorePaths {
+			if _, ok := downloaded[sp.BasePath]; ok {
+				continue
+			}
+			// Another root processed at the same time downloaded it
+			if parallelRoots > 0 && d.pathOnDisk(sp.BasePath) {
+				continue
+			}
+			failed++
+			if runCtx.Err() != nil {
+				incomplete = append(incomplete, storeDir+"/"+sp.BasePath)
+			}
+		}
+		metrics.Downloaded += len(done)
+		metrics.Failed += failed
+		mu.Unlock()
+
+		if gcRootDir != "" {
+			for _, base := range roots {
+				if !d.pathOnDisk(base) {
+					continue
+				}
+				if err := d.addGCRoot(base); err != nil {
+					log.Printf("Failed to add garbage collector root for %s/%s: %v", storeDir, base, err)
+					fail(err)
+				}
+			}
+		}
+	}
+
+	// With -parallel-roots the roots are discovered and downloaded on
+	// their own, the modes only printing the closure still discover it at
+	// once
+	rootsInParallel := parallelRoots > 0 && !printMissing && !closureSize && printGraphFormat == "" && !discoverOnly && !dryRun
+
+	// Phase 1: Discovery of the closure of all paths at once, shared
+	// dependencies are only fetched and downloaded once
+	var cl closure
+	var err error
+	discoveryStart := time.Now()
+	if opts.planFile != "" {
+		cl, err = d.loadPlan(opts.planFile)
+	} else {
+		if len(opts.excludeClosure) > 0 {
+			err = d.discoverExcludedClosure(opts.excludeClosure)
+		}
+		if err == nil && !rootsInParallel {
+			cl, err = d.discoverDependencies(paths)
+		}
+	}
+	timings.discovery = time.Since(discoveryStart)
+	switch {
+	case err != nil:
+		log.Printf("Error during discovery: %v", err)
+		fail(err)
+		metrics.Failed = len(paths)
+		if runCtx.Err() != nil {
+			for _, base := range paths {
+				incomplete = append(incomplete, storeDir+"/"+base)
+			}
+		}
+
+	case printMissing:
+		for _, base := range cl.Missing {
+			fmt.Printf("%s/%s\n", storeDir, base)
+		}
+
+	case closureSize:
+		printClosureSize(cl)
+
+	case printGraphFormat != "":
+		if err := printGraph(os.Stdout, cl, printGraphFormat); err != nil {
+			log.Fatalf("Failed to print graph: %v", err)
+		}
+
+	case discoverOnly:
+		if err := writePlan(os.Stdout, cl); err != nil {
+			log.Fatalf("Failed to write plan: %v", err)
+		}
+
+	case dryRun:
+		d.printPlan(cl.StorePaths)
+
+	case rootsInParallel:
+		parallelFor(len(paths), parallelRoots, func(i int) {
+			root := paths[i]
+			mu.Lock()
+			stopped := status != 0 && !keepGoing
+			mu.Unlock()
+			// Without -keep-going a failure stops the roots not started yet
+			if stopped || runCtx.Err() != nil {
+				mu.Lock()
+				metrics.Failed++
+				if runCtx.Err() != nil {
+					incomplete = append(incomplete, storeDir+"/"+root)
+				}
+				mu.Unlock()
+				return
+			}
+			start := time.Now()
+			cl, err := d.discoverDependencies([]string{root})
+			timings.mu.Lock()
+			timings.discovery += time.Since(start)
+			timings.mu.Unlock()
+			if err != nil {
+				log.Printf("Error during discovery of %s/%s: %v", storeDir, root, err)
+				fail(err)
+				mu.Lock()
+				metrics.Failed++
+				if runCtx.Err() != nil {
+					incomplete = append(incomplete, storeDir+"/"+root)
+				}
+				mu.Unlock()
+				return
+			}
+			fetchClosure(cl, []string{root})
+		})
+
+	default:
+		fetchClosure(cl, paths)
+	}
+
+	if exportNars {
+		err := writeExportEnd(exportWriter)
+		if err == nil {
+			err = exportWriter.Flush()
+		}
 		if err != nil {
-			log.Printf("Error during fetching and manifestation for %s: %v", path, err)
+			log.Fatalf("Failed to write export: %v", err)
+		}
+	}
+
+	if optimise {
+		logf(1, "Hard linking identical files saved %s", formatSize(optimisedBytes.Load()))
+	}
+
+	if len(skipped) > 0 {
+		log.Printf("Skipped %d paths, the downloaded closures are incomplete:", len(skipped))
+		for _, base := range skipped {
+			log.Printf("  %s/%s", storeDir, base)
+		}
+		// Like nix --keep-going, skipping paths still fails the run
+		if status == 0 {
+			status = exitFailure
+		}
+	}
+
+	if pathsFile != "" {
+		if err := writePaths(pathsFile, written); err != nil {
+			log.Fatalf("Failed to write paths: %v", err)
+		}
+	}
+
+	if traceTiming {
+		printTimings()
+	}
+
+	if metricsFile != "" {
+		if err := writeMetrics(metricsFile, metrics); err != nil {
+			log.Fatalf("Failed to write metrics: %v", err)
+		}
+	}
+
+	if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		log.Printf("Deadline of %s exceeded, %d paths are incomplete:", opts.deadline, len(incomplete))
+		for _, path := range incomplete {
+			log.Printf("  %s", path)
+		}
+		return exitFailure
+	}
+
+	return status
+}
+
+// httpGet is client.Get bound to runCtx, so that the -deadline cancels it,
+// and sending the -user-agent.
+func httpGet(client *http.Client, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(runCtx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	return client.Do(req)
+}
+
+// maxRedirects is the number of redirects followed like by the default
+// http.Client.
+const maxRedirects = 10
+
+// checkRedirect only follows redirects to the scheme of the original request.
+// The transports also serve file:// URLs for local substituters, a remote
+// cache could otherwise redirect requests to local files.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if req.URL.Scheme != via[0].URL.Scheme {
+		return fmt.Errorf("refusing redirect from %s to %s", via[0].URL.Redacted(), req.URL.Redacted())
+	}
+	return nil
+}
+
+// writePaths writes each path once, in order, to file.
+func writePaths(file string, paths []string) error {
+	var buf strings.Builder
+	seen := make(map[string]struct{})
+	for _, path := range paths {
+		if _, ok := seen[path]; ok {
 			continue
 		}
+		seen[path] = struct{}{}
+		buf.WriteString(path)
+		buf.WriteByte('\n')
 	}
+	return os.WriteFile(file, []byte(buf.String()), 0644)
 }
 
-func discoverDependencies(initialPath string) ([]StorePath, error) {
-	initialPath = strings.TrimPrefix(initialPath, "/nix/store/")
+// closure is the result of discovering the dependencies of a store path.
+type closure struct {
+	// StorePaths are the paths to download in topological order
+	StorePaths []StorePath
+	// Present are the base names of paths already in the store
+	Present []string
+	// Missing are the base names of paths no substituter has, only
+	// collected with -print-missing
+	Missing []string
+	// Skipped are the base names of paths whose narinfo could not be
+	// fetched with -keep-going
+	Skipped []string
+	// PresentStorePaths are the narinfos of the present paths, only fetched
+	// with -closure-size
+	PresentStorePaths []StorePath
+}
+
+// discoverDependencies discovers the closure of all of roots, the base names
+// of store paths.
+func (d *Downloader) discoverDependencies(roots []string) (closure, error) {
 	visited := make(map[string]struct{})
-	toVisit := []string{initialPath}
+	toVisit := slices.Clone(roots)
 	var result []StorePath
-
+	var present []string
+	var missing []string
+	var skipped []string
+	var presentStorePaths []StorePath
+	// debugPaths are the -with-debug outputs, skipped if no substituter has
+	// them
+	debugPaths := make(map[string]struct{})
+
+	// Discover the graph level by level, fetching the narinfos of each level
+	// concurrently. This yields the same order as a sequential breadth first
+	// search.
 	for len(toVisit) > 0 {
-		path := toVisit[0]
-		toVisit = toVisit[1:]
+		var level []string
+		// levelPresent[i] is set for paths of the level that are only fetched
+		// for -closure-size or to be checked by -paranoid
+		var levelPresent []bool
+		for _, path := range toVisit {
+			if _, ok := visited[path]; ok {
+				continue
+			}
+			visited[path] = struct{}{}
+
+			// The closure of -exclude-closure is known to be present
+			// elsewhere, the store is not checked for it
+			if sp, ok := excludedClosure[path]; ok {
+				present = append(present, path)
+				if closureSize {
+					presentStorePaths = append(presentStorePaths, sp)
+				}
+				continue
+			}
 
-		if _, ok := visited[path]; ok {
-			continue
+			// Check if the path already exists on disk
+			if d.isPresent(path) {
+				if checkPresent() {
+					level = append(level, path)
+					levelPresent = append(levelPresent, true)
+					continue
+				}
+				present = append(present, path)
+				if !closureSize {
+					continue
+				}
+				level = append(level, path)
+				levelPresent = append(levelPresent, true)
+				continue
+			}
+			level = append(level, path)
+			levelPresent = append(levelPresent, false)
 		}
-		visited[path] = struct{}{}
+		toVisit = nil
+
+		storePaths := make([]StorePath, len(level))
+		errs := make([]error, len(level))
+		debugs := make([]string, len(level))
+		parallelFor(len(level), discoveryJobs, func(i int) {
+			storePaths[i], errs[i] = d.fetchNarInfo(level[i])
+			if withDebug && errs[i] == nil && !levelPresent[i] {
+				debugs[i] = d.debugOutput(storePaths[i])
+			}
+			if perSubstituterJobs > 0 && errs[i] == nil && !levelPresent[i] {
+				d.fetchNarMirrors(storePaths[i])
+			}
+		})
 
-		// Check if the path already exists on disk
-		if _, err := os.Stat(filepath.Join(nixStore, path)); err == nil {
-			continue
-		}
+		for i, path := range level {
+			storePath, err := storePaths[i], errs[i]
+			if _, ok := debugPaths[path]; ok && errors.Is(err, errNarInfoNotFound) {
+				logf(1, "Debug output %s/%s is not available", storeDir, path)
+				continue
+			}
+			if levelPresent[i] && checkPresent() {
+				if err := d.checkPresentPath(path, storePath, err); err != nil {
+					log.Printf("Warning: %s/%s looks corrupt, downloading it again: %v", storeDir, path, err)
+					corruptPaths[path] = struct{}{}
+					levelPresent[i] = false
+				} else {
+					// The references are checked as well
+					present = append(present, path)
+				}
+			}
+			if levelPresent[i] {
+				// Locally built paths are not on any substituter
+				if err != nil {
+					log.Printf("Warning: size of present path %s is unknown: %v", path, err)
+					continue
+				}
+				presentStorePaths = append(presentStorePaths, storePath)
+				for _, ref := range storePath.References {
+					if _, ok := visited[ref]; !ok && followReference(ref) {
+						toVisit = append(toVisit, ref)
+					}
+				}
+				continue
+			}
+			if err == nil && len(allowedCompressions) > 0 && !slices.Contains(allowedCompressions, storePath.Compression) {
+				err = fmt.Errorf("compression %s is not allowed (see -allow-compression)", storePath.Compression)
+			}
+			if printMissing && errors.Is(err, errNarInfoNotFound) {
+				missing = append(missing, path)
+				continue
+			}
+			if err != nil && keepGoing {
+				log.Printf("Warning: skipping %s and its dependencies: %v", path, err)
+				skipped = append(skipped, path)
+				continue
+			}
+			if err != nil {
+				return closure{}, fmt.Errorf("error fetching narinfo for %s: %w", path, err)
+			}
 
-		storePath, err := fetchNarInfo(path)
-		if err != nil {
-			return nil, fmt.Errorf("error fetching narinfo for %s: %w", path, err)
-		}
+			result = append(result, storePath)
 
-		result = append(result, storePath)
+			if _, ok := visited[debugs[i]]; debugs[i] != "" && !ok {
+				debugPaths[debugs[i]] = struct{}{}
+				toVisit = append(toVisit, debugs[i])
+			}
 
-		// Add references to toVisit
-		for _, ref := range storePath.References {
-			if _, ok := visited[ref]; !ok {
+			// Add references to toVisit
+			for _, ref := range storePath.References {
+				if _, ok := visited[ref]; ok {
+					continue
+				}
+				if !followReference(ref) {
+					logf(1, "Not following reference %s/%s of %s/%s (see -ref-filter)", storeDir, ref, storeDir, path)
+					visited[ref] = struct{}{}
+					continue
+				}
 				toVisit = append(toVisit, ref)
 			}
 		}
 	}
 
-	// Reverse to get a proper topological sorted order
+	// Reverse to get the dependencies first, sorting is still needed since
+	// with several roots or shared dependencies a path can be discovered
+	// before one of its references
 	slices.Reverse(result)
+	result = sortTopologically(result)
+	slices.Reverse(present)
+
+	return closure{StorePaths: result, Present: present, Missing: missing, Skipped: skipped, PresentStorePaths: presentStorePaths}, nil
+}
+
+// sortTopologically orders storePaths so that each path comes after its
+// references, keeping the order of unrelated paths.
+func sortTopologically(storePaths []StorePath) []StorePath {
+	byBase := make(map[string]StorePath, len(storePaths))
+	for _, sp := range storePaths {
+		byBase[sp.BasePath] = sp
+	}
+	sorted := make([]StorePath, 0, len(storePaths))
+	visited := make(map[string]struct{}, len(storePaths))
+	var visit func(sp StorePath)
+	visit = func(sp StorePath) {
+		if _, ok := visited[sp.BasePath]; ok {
+			return
+		}
+		visited[sp.BasePath] = struct{}{}
+		for _, ref := range sp.References {
+			if dep, ok := byBase[ref]; ok {
+				visit(dep)
+			}
+		}
+		sorted = append(sorted, sp)
+	}
+	for _, sp := range storePaths {
+		visit(sp)
+	}
+	return sorted
+}
+
+// checkClosureComplete verifies that every reference of the paths to download
+// is either present or downloaded as well. The references of present paths
+// are assumed to be present, as the store guarantees.
+func checkClosureComplete(cl closure) error {
+	available := make(map[string]struct{}, len(cl.StorePaths)+len(cl.Present))
+	for _, sp := range cl.StorePaths {
+		available[sp.BasePath] = struct{}{}
+	}
+	for _, base := range cl.Present {
+		available[base] = struct{}{}
+	}
+
+	var missing []string
+	for _, sp := range cl.StorePaths {
+		for _, ref := range sp.References {
+			if _, ok := available[ref]; !ok {
+				missing = append(missing, fmt.Sprintf("%s/%s (referenced by %s)", storeDir, ref, sp.BasePath))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing references:\n  %s", strings.Join(missing, "\n  "))
+	}
+	return nil
+}
+
+// maxNarInfoSize bounds the size of a narinfo, real ones are a few KiB at most
+const maxNarInfoSize = 1024 * 1024
+
+// minReadBufferSize is the smallest -read-buffer-size, smaller buffers mean
+// more reads than they save memory.
+const minReadBufferSize = 4 * 1024
+
+// errNarInfoNotFound is returned by fetchNarInfo if no substituter has the path.
+var errNarInfoNotFound = errors.New("narinfo not found on any substituter")
+
+// narInfoError is returned by fetchNarInfo if no substituter served the
+// narinfo and not all of them just did not have it. It lists what each of
+// them returned.
+type narInfoError struct {
+	substituters []string
+	errs         []error
+}
+
+func (e *narInfoError) Error() string {
+	parts := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msg := err.Error()
+		var statusErr *httpStatusError
+		if errors.As(err, &statusErr) {
+			msg = statusErr.status
+		}
+		parts[i] = e.substituters[i] + ": " + msg
+	}
+	return "failed to fetch narinfo: " + strings.Join(parts, ", ")
+}
+
+func (e *narInfoError) Unwrap() []error {
+	return e.errs
+}
+
+// parallelFor calls f for 0 <= i < n with at most jobs calls in parallel.
+func parallelFor(n, jobs int, f func(i int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, jobs)
+	for i := range n {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(i)
+		}()
+	}
+	wg.Wait()
+}
 
-	return result, nil
+// isPresent reports whether storeBase was completed according to the -state
+// file or is already in the store or, with -download-only, in the binary
+// cache directory.
+func (d *Downloader) isPresent(storeBase string) bool {
+	return inState(storeBase) || d.pathOnDisk(storeBase)
 }
 
-func fetchNarInfo(storeBase string) (StorePath, error) {
+// pathOnDisk reports whether storeBase is in the store or, with
+// -download-only, in the binary cache directory.
+func (d *Downloader) pathOnDisk(storeBase string) bool {
+	if downloadOnlyDir != "" {
+		hash, _, _ := strings.Cut(storeBase, "-")
+		_, err := os.Stat(filepath.Join(downloadOnlyDir, hash+".narinfo"))
+		return err == nil
+	}
+	_, err := os.Stat(filepath.Join(d.NixStore, storeBase))
+	return err == nil
+}
+
+func (d *Downloader) fetchNarInfo(storeBase string) (StorePath, error) {
+	return d.fetchNarInfoFrom(storeBase, d.Substituters)
+}
+
+// fetchNarInfoFrom fetches the narinfo of storeBase from the first of subs
+// that has it.
+func (d *Downloader) fetchNarInfoFrom(storeBase string, subs []string) (StorePath, error) {
 	hash, _, _ := strings.Cut(filepath.Base(storeBase), "-")
-	var resp *http.Response
-	var err error
+	var body []byte
 	var substituter string
-
-	for _, substituter = range substituters {
-		resp, err = narInfoClient.Get(fmt.Sprintf("%s/%s.narinfo", substituter, hash))
+	// redirectedTo is the base URL of the narinfo if it was redirected
+	var redirectedTo string
+	// failed collects what each substituter returned instead of the narinfo
+	failed := &narInfoError{}
+	notFound := true
+	found := false
+
+	for _, substituter = range subs {
+		if offline && !isLocalURL(substituter) {
+			continue
+		}
+		narInfoURL, err := substituterURL(substituter, hash+".narinfo")
+		if err != nil {
+			return StorePath{}, err
+		}
+		release := acquireNarInfoSlot(substituter)
+		resp, err := httpGet(d.NarInfoClient, narInfoURL)
 		if err == nil && resp.StatusCode == http.StatusOK {
+			body, err = io.ReadAll(io.LimitReader(resp.Body, maxNarInfoSize+1))
+			resp.Body.Close()
+			release()
+			if err != nil {
+				return StorePath{}, fmt.Errorf("failed to read narinfo: %w", err)
+			}
+			// checkRedirect keeps the redirects within the scheme of
+			// the substituter
+			if resp.Request != nil && resp.Request.URL.String() != narInfoURL {
+				redirectedTo = urlDir(resp.Request.URL)
+			}
+			found = true
+			recordSubstituterHit(substituter)
 			break
 		}
-		if resp != nil {
+		release()
+		if err == nil {
 			resp.Body.Close()
+			err = &httpStatusError{"narinfo", resp.Status}
+			if resp.StatusCode != http.StatusNotFound {
+				notFound = false
+			}
+		} else {
+			notFound = false
 		}
+		failed.substituters = append(failed.substituters, substituter)
+		failed.errs = append(failed.errs, err)
 	}
-	if err != nil {
-		return StorePath{}, err
+	if !found {
+		switch {
+		case len(failed.errs) == 0:
+			return StorePath{}, fmt.Errorf("offline: no local substituter to fetch %s from", storeBase)
+		case notFound:
+			return StorePath{}, fmt.Errorf("%w (tried %s)", errNarInfoNotFound, strings.Join(failed.substituters, ", "))
+		default:
+			return StorePath{}, failed
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return StorePath{}, fmt.Errorf("failed to fetch narinfo: %s", resp.Status)
+	narInfo := make(map[string]string)
+
+	if len(body) > maxNarInfoSize {
+		return StorePath{}, fmt.Errorf("narinfo exceeds maximum size of %d bytes", maxNarInfoSize)
 	}
 
-	narInfo := make(map[string]string)
-	var references []string
-	var narURL string
+	if err := checkNarInfoIndex(hash, body); err != nil {
+		return StorePath{}, err
+	}
 
-	infoStorePath := ""
-	scanner := bufio.NewScanner(resp.Body)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, maxNarInfoSize)
+	var sigs []string
 	for scanner.Scan() {
-		line := scanner.Text()
+		line := strings.TrimSuffix(scanner.Text(), "\r")
 		key, value, ok := strings.Cut(line, ": ")
 		if ok {
-			narInfo[key] = value
-			switch key {
-			case "References":
-				references = strings.Fields(value)
-			case "URL":
-				narURL = fmt.Sprintf("%s/%s", substituter, value)
-			case "StorePath":
-				infoStorePath = value
+			// Sig may legitimately appear once per signing key, everything
+			// else is single-valued and a duplicate is ambiguous
+			if key == "Sig" {
+				sigs = append(sigs, value)
+				continue
+			}
+			if _, dup := narInfo[key]; dup {
+				return StorePath{}, fmt.Errorf("duplicate narinfo field %s", key)
 			}
+			narInfo[key] = value
 		}
 	}
 
@@ -205,51 +1210,304 @@ func fetchNarInfo(storeBase string) (StorePath, error) {
 		return StorePath{}, err
 	}
 
-	storePath := "/nix/store/" + storeBase
+	sp, err := d.newStorePath(storeBase, substituter, narInfo, sigs, slices.Contains(d.AllowUnsigned, substituter))
+	if err != nil {
+		return StorePath{}, err
+	}
+	// The NAR URL of a redirected narinfo, e.g. to a CDN, is relative to
+	// where it was served from
+	if redirectedTo != "" {
+		logf(1, "Narinfo of %s was redirected to %s", storeBase, redirectedTo)
+		if sp.NarURL, err = resolveNarURL(redirectedTo, narInfo["URL"]); err != nil {
+			return StorePath{}, err
+		}
+	}
+	logf(1, "Fetched narinfo for %s from %s", storeBase, substituter)
+	return sp, nil
+}
+
+// newStorePath validates the narinfo fields of storeBase fetched from
+// substituter and verifies its signatures unless allowUnsigned is set.
+func (d *Downloader) newStorePath(storeBase, substituter string, narInfo map[string]string, sigs []string, allowUnsigned bool) (StorePath, error) {
+	for _, key := range []string{"StorePath", "URL", "NarHash", "NarSize"} {
+		if _, ok := narInfo[key]; !ok {
+			return StorePath{}, fmt.Errorf("narinfo is missing required field %s", key)
+		}
+	}
+
+	references := strings.Fields(narInfo["References"])
+	for _, ref := range references {
+		if err := checkStorePathName(ref); err != nil {
+			return StorePath{}, fmt.Errorf("invalid reference: %w", err)
+		}
+	}
+	if deriver, ok := narInfo["Deriver"]; ok && deriver != "unknown-deriver" {
+		if err := checkStorePathName(deriver); err != nil {
+			return StorePath{}, fmt.Errorf("invalid deriver: %w", err)
+		}
+	}
+	narURL, err := resolveNarURL(substituter, narInfo["URL"])
+	if err != nil {
+		return StorePath{}, err
+	}
+
+	infoStorePath := narInfo["StorePath"]
+	storePath := storeDir + "/" + storeBase
+	if dir := filepath.Dir(infoStorePath); dir != storeDir {
+		return StorePath{}, fmt.Errorf("narinfo from %s is for store directory %s, but only %s paths can be verified (see -store-dir)", substituter, dir, storeDir)
+	}
 	if storePath != infoStorePath {
 		return StorePath{}, fmt.Errorf("unexpected narinfo store path expected: %s, got: %s", storePath, infoStorePath)
 	}
 
-	// Verify the signature
-	if err := verifyNarInfoSignature(narInfo); err != nil {
-		return StorePath{}, fmt.Errorf("signature verification failed: %w", err)
+	// Verify the signature
+	if allowUnsigned {
+		logf(2, "Not verifying the signatures of %s from %s (see -allow-unsigned-from)", storeBase, substituter)
+	} else if err := d.verifyNarInfoSignature(narInfo, sigs); err != nil {
+		return StorePath{}, fmt.Errorf("%w: %w", errVerification, err)
+	}
+
+	narSize, err := strconv.ParseInt(narInfo["NarSize"], 10, 64)
+	if err != nil {
+		return StorePath{}, fmt.Errorf("invalid NarSize: %w", err)
+	}
+
+	// FileSize is optional, uncompressed NARs are transferred as is
+	fileSize := narSize
+	if value, ok := narInfo["FileSize"]; ok {
+		fileSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return StorePath{}, fmt.Errorf("invalid FileSize: %w", err)
+		}
+	}
+
+	narHash := narInfo["NarHash"]
+	if !strings.HasPrefix(narHash, "sha256:") {
+		return StorePath{}, fmt.Errorf("unsupported hash algorithm: %s", narHash)
+	}
+
+	sort.Strings(references)
+
+	// Some caches omit the compression, it is detected from the NAR then
+	compression := narInfo["Compression"]
+	if compression == "" {
+		compression = "unknown"
+	}
+
+	return StorePath{
+		BasePath:    storeBase,
+		References:  references,
+		NarURL:      narURL,
+		Compression: compression,
+		NarSize:     narSize,
+		FileSize:    fileSize,
+		NarHash:     narHash,
+		Substituter: substituter,
+		NarInfo:     narInfo,
+		Sigs:        sigs,
+	}, nil
+}
+
+// maxStorePathNameLen is the longest name Nix allows after the hash.
+const maxStorePathNameLen = 211
+
+// checkStorePathName checks that base is a store path base name, i.e. a nix
+// base32 hash, a dash and a name consisting of allowed characters.
+func checkStorePathName(base string) error {
+	hash, name, ok := strings.Cut(base, "-")
+	if !ok || len(hash) != 32 {
+		return fmt.Errorf("%q is not a store path name", base)
+	}
+	for _, c := range []byte(hash) {
+		if strings.IndexByte(nix32Chars, c) < 0 {
+			return fmt.Errorf("%q has an invalid hash", base)
+		}
+	}
+	if name == "" || len(name) > maxStorePathNameLen || name[0] == '.' {
+		return fmt.Errorf("%q has an invalid name", base)
+	}
+	for _, c := range []byte(name) {
+		valid := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("+-._?=", c) >= 0
+		if !valid {
+			return fmt.Errorf("%q contains invalid character %q", base, c)
+		}
+	}
+	return nil
+}
+
+// parseStoreBase returns the base name of path, a store path in storeDir or
+// a base name as found in files written by nix-download.
+func parseStoreBase(path string) (string, error) {
+	base := strings.TrimPrefix(path, storeDir+"/")
+	if err := checkStorePathName(base); err != nil {
+		return "", err
+	}
+	return base, nil
+}
+
+// storePathBase returns the base name of the store path given on the command
+// line, either as a base name or as a path in or a symlink into the store
+// directory like ./result.
+func (d *Downloader) storePathBase(arg string) (string, error) {
+	// A bare name is a base name unless it is a file in the working
+	// directory, like a result link
+	if !strings.Contains(arg, "/") {
+		err := checkStorePathName(arg)
+		if err == nil {
+			return arg, nil
+		}
+		if _, statErr := os.Lstat(arg); statErr != nil {
+			return "", fmt.Errorf("%s is not a valid store path: %w", arg, err)
+		}
+	}
+	path := d.resolveStorePath(arg)
+	for _, dir := range d.storeDirs() {
+		if rel, ok := strings.CutPrefix(path, dir+"/"); ok {
+			base, _, _ := strings.Cut(rel, "/")
+			if err := checkStorePathName(base); err != nil {
+				return "", fmt.Errorf("%s is not a valid store path: %w", arg, err)
+			}
+			return base, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not a valid store path: not in %s", arg, storeDir)
+}
+
+// resolveStorePath follows the symlinks in path until it is in the store
+// directory. Store paths need not exist locally, so the links are resolved one
+// by one instead of resolving the whole path.
+func (d *Downloader) resolveStorePath(path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	for range 40 {
+		for _, dir := range d.storeDirs() {
+			if strings.HasPrefix(path, dir+"/") {
+				return path
+			}
+		}
+		// Replace the first symlink from the root, e.g. result in
+		// ./result/bin/hello
+		link, target := "", ""
+		for _, prefix := range pathPrefixes(path) {
+			if target, err = os.Readlink(prefix); err == nil {
+				link = prefix
+				break
+			}
+		}
+		if link == "" {
+			break
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(link), target)
+		}
+		path = filepath.Join(target, strings.TrimPrefix(path, link))
+	}
+	return path
+}
+
+// pathPrefixes returns the parent directories of the clean absolute path,
+// starting from the root, and path itself.
+func pathPrefixes(path string) []string {
+	var prefixes []string
+	for p := path; p != filepath.Dir(p); p = filepath.Dir(p) {
+		prefixes = append(prefixes, p)
+	}
+	slices.Reverse(prefixes)
+	return prefixes
+}
+
+// storeDirs are the directories store paths given on the command line can be
+// in, the logical store directory and the -store directory.
+func (d *Downloader) storeDirs() []string {
+	dirs := []string{storeDir}
+	if store, err := filepath.Abs(d.NixStore); err == nil && store != storeDir {
+		dirs = append(dirs, store)
+	}
+	return dirs
+}
+
+// resolveNarURL resolves the URL field of a narinfo against the substituter it
+// was fetched from and rejects URLs that would point outside of it.
+func resolveNarURL(substituter, ref string) (string, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid NAR URL %q: %w", ref, err)
+	}
+	if u.Scheme != "" || u.Host != "" || u.Opaque != "" || strings.HasPrefix(u.Path, "/") {
+		return "", fmt.Errorf("NAR URL %q is not relative to the substituter", ref)
+	}
+	if slices.Contains(strings.Split(u.Path, "/"), "..") {
+		return "", fmt.Errorf("NAR URL %q escapes the substituter", ref)
+	}
+	return substituterURL(substituter, ref)
+}
+
+// urlDir returns the URL of the directory containing u without a trailing
+// slash, in the form of a substituter URL.
+func urlDir(u *url.URL) string {
+	dir := *u
+	dir.RawQuery = ""
+	dir.Fragment = ""
+	dir.Path = path.Dir(u.Path)
+	dir.RawPath = ""
+	return strings.TrimSuffix(dir.String(), "/")
+}
+
+// substituterURL resolves the relative URL ref against the substituter, which
+// may include a path prefix.
+func substituterURL(substituter, ref string) (string, error) {
+	base, err := url.Parse(substituter + "/")
+	if err != nil {
+		return "", err
 	}
-
-	narSize, err := strconv.ParseInt(narInfo["NarSize"], 10, 64)
+	u, err := url.Parse(ref)
 	if err != nil {
-		return StorePath{}, fmt.Errorf("invalid NarSize: %w", err)
+		return "", err
 	}
-
-	narHash := narInfo["NarHash"]
-	if !strings.HasPrefix(narHash, "sha256:") {
-		return StorePath{}, fmt.Errorf("unsupported hash algorithm: %s", narHash)
+	resolved := base.ResolveReference(u)
+	if resolved.Scheme != base.Scheme || resolved.Host != base.Host || !strings.HasPrefix(resolved.Path, base.Path) {
+		return "", fmt.Errorf("URL %q is outside of substituter %s", ref, substituter)
 	}
-
-	sort.Strings(references)
-
-	return StorePath{
-		BasePath:    storeBase,
-		References:  references,
-		NarURL:      narURL,
-		Compression: narInfo["Compression"],
-		NarSize:     narSize,
-		NarHash:     narHash,
-	}, nil
+	return resolved.String(), nil
 }
 
-func verifyNarInfoSignature(narInfo map[string]string) error {
-	sig, ok := narInfo["Sig"]
-	if !ok {
-		return fmt.Errorf("no signature found in narinfo")
+// verifyNarInfoSignature succeeds if any of sigs is a valid signature of
+// narInfo by a known key, or if narInfo is for a content-addressed path that
+// can be verified by its NarHash, see checkContentAddress.
+func (d *Downloader) verifyNarInfoSignature(narInfo map[string]string, sigs []string) error {
+	var errs []error
+	if len(sigs) == 0 {
+		errs = append(errs, fmt.Errorf("no signature found in narinfo"))
+	}
+	for _, sig := range sigs {
+		err := d.verifySig(narInfo, sig)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+
+	if _, ok := narInfo["CA"]; ok {
+		err := checkContentAddress(narInfo)
+		if err == nil {
+			logf(1, "Accepting %s as content-addressed", narInfo["StorePath"])
+			return nil
+		}
+		errs = append(errs, err)
 	}
+	return errors.Join(errs...)
+}
 
+func (d *Downloader) verifySig(narInfo map[string]string, sig string) error {
 	sigParts := strings.SplitN(sig, ":", 2)
 	if len(sigParts) != 2 {
 		return fmt.Errorf("invalid signature format")
 	}
 
 	keyName, sigBase64 := sigParts[0], sigParts[1]
-	publicKey, ok := knownKeys[keyName]
+	publicKey, ok := d.KnownKeys[keyName]
 	if !ok {
 		return fmt.Errorf("unknown key: %s", keyName)
 	}
@@ -259,7 +1517,7 @@ func verifyNarInfoSignature(narInfo map[string]string) error {
 		return fmt.Errorf("invalid signature encoding: %w", err)
 	}
 
-	message := buildSignatureMessage(narInfo)
+	message := buildSignatureMessage(storeDir, narInfo)
 
 	if !ed25519.Verify(publicKey, []byte(message), signature) {
 		return fmt.Errorf("invalid signature")
@@ -268,11 +1526,54 @@ func verifyNarInfoSignature(narInfo map[string]string) error {
 	return nil
 }
 
-func buildSignatureMessage(narInfo map[string]string) string {
+// secretKey is an ed25519 signing key in Nix's name:base64secret format.
+type secretKey struct {
+	name string
+	key  ed25519.PrivateKey
+}
+
+func loadSecretKey(path string) (secretKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return secretKey{}, err
+	}
+	name, keyBase64, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !ok || name == "" {
+		return secretKey{}, fmt.Errorf("invalid secret key format in %s", path)
+	}
+	key, err := base64.StdEncoding.DecodeString(keyBase64)
+	if err != nil {
+		return secretKey{}, fmt.Errorf("invalid base64 encoding for secret key %s: %w", name, err)
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return secretKey{}, fmt.Errorf("invalid secret key size for %s: %d", name, len(key))
+	}
+	return secretKey{name: name, key: ed25519.PrivateKey(key)}, nil
+}
+
+// signNarInfo signs the fingerprint of narInfo and returns the value of a Sig
+// line, i.e. name:base64sig.
+func signNarInfo(narInfo map[string]string, sk secretKey) string {
+	message := buildSignatureMessage(storeDir, narInfo)
+	signature := ed25519.Sign(sk.key, []byte(message))
+	return sk.name + ":" + base64.StdEncoding.EncodeToString(signature)
+}
+
+// appendSig appends a Sig line signed with sk to the narinfo text.
+func appendSig(text []byte, narInfo map[string]string, sk secretKey) []byte {
+	if len(text) > 0 && text[len(text)-1] != '\n' {
+		text = append(text, '\n')
+	}
+	return fmt.Appendf(text, "Sig: %s\n", signNarInfo(narInfo, sk))
+}
+
+// buildSignatureMessage returns the fingerprint of narInfo that is signed,
+// references are expanded to full paths in dir.
+func buildSignatureMessage(dir string, narInfo map[string]string) string {
 	refs := strings.Fields(narInfo["References"])
 	paths := make([]string, len(refs))
 	for i, ref := range refs {
-		paths[i] = "/nix/store/" + ref
+		paths[i] = dir + "/" + ref
 	}
 	return fmt.Sprintf("1;%s;%s;%s;%s",
 		narInfo["StorePath"],
@@ -281,128 +1582,797 @@ func buildSignatureMessage(narInfo map[string]string) string {
 		strings.Join(paths, ","))
 }
 
-func fetchAndManifestStorePaths(storePaths []StorePath) error {
+// printPlan prints the paths that would be downloaded along with the
+// compression they are available in and their total size. Paths already in
+// the store are not part of the plan.
+func (d *Downloader) printPlan(storePaths []StorePath) {
+	for _, sp := range storePaths {
+		destPath := filepath.Join(d.NixStore, sp.BasePath)
+		note := ""
+		if len(preferredCompressions) > 0 {
+			switch rank := slices.Index(preferredCompressions, sp.Compression); rank {
+			case -1:
+				note = ", not preferred"
+			case 0:
+				note = ", preferred"
+			default:
+				note = fmt.Sprintf(", preference %d", rank+1)
+			}
+		}
+		fmt.Printf("%s (%s%s)\n", destPath, sp.Compression, note)
+	}
+
+	var downloadSize, unpackedSize int64
+	for _, sp := range storePaths {
+		downloadSize += sp.FileSize
+		unpackedSize += sp.NarSize
+	}
+	fmt.Printf("%d paths will be fetched (%s download, %s unpacked)\n", len(storePaths), formatSize(downloadSize), formatSize(unpackedSize))
+}
+
+// printClosureSize prints the number of paths and the total size of the
+// closure, like nix path-info -S, and separately that of the paths not yet
+// present.
+func printClosureSize(cl closure) {
+	var newDownload, newUnpacked int64
+	for _, sp := range cl.StorePaths {
+		newDownload += sp.FileSize
+		newUnpacked += sp.NarSize
+	}
+	download, unpacked := newDownload, newUnpacked
+	for _, sp := range cl.PresentStorePaths {
+		download += sp.FileSize
+		unpacked += sp.NarSize
+	}
+	total := len(cl.StorePaths) + len(cl.Present)
+	fmt.Printf("%d paths (%s download, %s unpacked)\n", total, formatSize(download), formatSize(unpacked))
+	fmt.Printf("%d new paths (%s download, %s unpacked)\n", len(cl.StorePaths), formatSize(newDownload), formatSize(newUnpacked))
+}
+
+func formatSize(size int64) string {
+	return fmt.Sprintf("%.2f MiB", float64(size)/(1024*1024))
+}
+
+func printPath(destPath string, sp StorePath) {
+	// With -export stdout carries the export stream
+	if quiet || exportNars {
+		return
+	}
+	if jsonOutput {
+		data, err := json.Marshal(pathResult{Path: destPath, Substituter: sp.Substituter})
+		if err != nil {
+			log.Printf("Failed to print %s: %v", destPath, err)
+			return
+		}
+		fmt.Printf("%s\n", data)
+		return
+	}
+	fmt.Printf("%s\n", destPath)
+}
+
+// fetchAndManifestStorePaths downloads storePaths and returns the ones that
+// were successfully manifested, in order. Paths downloaded by another root
+// processed at the same time with -parallel-roots are waited for but not
+// returned.
+func (d *Downloader) fetchAndManifestStorePaths(storePaths []StorePath) ([]StorePath, error) {
 	var wg sync.WaitGroup
-	n := min(8, len(storePaths))
-	ch := make(chan func() error)
-	errors := make(chan error, n)
+	n := min(jobs, len(storePaths))
+	// release frees the -per-substituter-jobs slot of a task, also when
+	// it is dropped without running after a failure
+	type task struct {
+		run     func() error
+		release func()
+	}
+	ch := make(chan task)
+	done := make([]bool, len(storePaths))
+	var mu sync.Mutex
+	var errs []error
+
+	ctx, cancel := context.WithCancel(runCtx)
+	defer cancel()
+
+	// The daemon and nix-store --import only accept paths whose references
+	// are valid, so each path waits for those of its references that are
+	// imported in this batch.
+	batchIndex := make(map[string]int, len(storePaths))
+	processed := make([]chan struct{}, len(storePaths))
+	for i, sp := range storePaths {
+		batchIndex[sp.BasePath] = i
+		processed[i] = make(chan struct{})
+	}
+	waitForReferences := func(sp StorePath) error {
+		for _, ref := range sp.References {
+			j, ok := batchIndex[ref]
+			if !ok || ref == sp.BasePath {
+				continue
+			}
+			select {
+			case <-processed[j]:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if !done[j] {
+				return fmt.Errorf("reference %s/%s could not be imported", storeDir, ref)
+			}
+		}
+		return nil
+	}
 
 	go func() {
 		defer close(ch)
-		for _, sp := range storePaths {
-			destPath := filepath.Join(nixStore, sp.BasePath)
-			ch <- func() error {
-				if err := fetchAndManifestStorePath(destPath, sp); err != nil {
+		for i, sp := range storePaths {
+			destPath := filepath.Join(d.NixStore, sp.BasePath)
+			fetch := d.fetchAndManifestStorePath
+			if downloadOnlyDir != "" {
+				destPath = storeDir + "/" + sp.BasePath
+				fetch = func(_ string, sp StorePath) error { return d.downloadNar(sp) }
+			}
+			if useDaemon {
+				destPath = storeDir + "/" + sp.BasePath
+				fetch = func(destPath string, sp StorePath) error {
+					if err := waitForReferences(sp); err != nil {
+						return err
+					}
+					return d.importNar(destPath, sp)
+				}
+			}
+			if exportNars {
+				destPath = storeDir + "/" + sp.BasePath
+				fetch = func(destPath string, sp StorePath) error {
+					f, err := d.fetchNarToFile(destPath, sp)
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+					// The stream is written in order so that nix-store
+					// --import sees the references of a path first
+					for j := range i {
+						select {
+						case <-processed[j]:
+						case <-ctx.Done():
+							return ctx.Err()
+						}
+					}
+					if err := waitForReferences(sp); err != nil {
+						return err
+					}
+					return writeExport(exportWriter, sp, f)
+				}
+			}
+			// The slots are taken in the order of the paths, so a path only
+			// waits for those before it
+			sp, release, err := acquireNarSlot(ctx, sp)
+			if err != nil {
+				return
+			}
+			run := func() error {
+				defer close(processed[i])
+				wait, finish := claimPath(sp.BasePath)
+				if wait != nil {
+					if err := wait(ctx); err != nil {
+						return fmt.Errorf("error processing %s: %w", destPath, err)
+					}
+					return nil
+				}
+				releaseJob, err := acquireJobSlot(ctx)
+				if err != nil {
+					finish(err)
+					return err
+				}
+				defer releaseJob()
+				emitProgress(progressEvent{Action: "start", Path: destPath, BytesTotal: sp.NarSize})
+				sp, err := d.fetchWithFallback(fetch, destPath, sp)
+				finish(err)
+				storePaths[i] = sp
+				if err != nil {
+					emitProgress(progressEvent{Action: "error", Path: destPath, Error: err.Error()})
 					return fmt.Errorf("error processing %s: %w", destPath, err)
 				}
+				emitProgress(progressEvent{Action: "done", Path: destPath})
+				done[i] = true
+				// sp names the substituter the NAR actually came from
+				printPath(destPath, sp)
+				if err := recordState(sp.BasePath); err != nil {
+					log.Printf("Warning: failed to record %s in the state file: %v", destPath, err)
+				}
 				return nil
 			}
-			fmt.Printf("%s\n", destPath)
+			select {
+			case ch <- task{run, release}:
+			case <-ctx.Done():
+				release()
+				return
+			}
 		}
 	}()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 	for range n {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for f := range ch {
+			for t := range ch {
 				if ctx.Err() != nil {
+					t.release()
 					return
 				}
-				if err := f(); err != nil {
-					cancel()
-					errors <- err
-					return
+				err := t.run()
+				t.release()
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+					if !keepGoing {
+						cancel()
+						return
+					}
 				}
 			}
 		}()
 	}
 
 	wg.Wait()
-	close(errors)
 
-	for err := range errors {
+	var manifested []StorePath
+	for i, sp := range storePaths {
+		if done[i] {
+			manifested = append(manifested, sp)
+		}
+	}
+
+	return manifested, errors.Join(errs...)
+}
+
+// fetchWithFallback calls fetch for sp and, if the NAR is corrupt, retries
+// with the other substituters having the path in turn. A single corrupt
+// mirror thus does not fail the path. It returns sp as fetched from the last
+// substituter tried.
+func (d *Downloader) fetchWithFallback(fetch func(destPath string, sp StorePath) error, destPath string, sp StorePath) (StorePath, error) {
+	err := fetch(destPath, sp)
+	tried := []string{sp.Substituter}
+	for err != nil && exitCode(err) == exitHashMismatch {
+		log.Printf("Warning: NAR of %s from %s is corrupt: %v", destPath, sp.Substituter, err)
+		next, ok := d.nextNarInfo(sp, &tried)
+		if !ok {
+			break
+		}
+		logf(1, "Retrying %s from %s", destPath, next.Substituter)
+		sp = next
+		err = fetch(destPath, sp)
+	}
+	return sp, err
+}
+
+// nextNarInfo fetches the narinfo of sp from the first substituter not in
+// tried that has the path with the same contents, adding the substituters
+// asked to tried.
+func (d *Downloader) nextNarInfo(sp StorePath, tried *[]string) (StorePath, bool) {
+	for {
+		var rest []string
+		for _, substituter := range d.Substituters {
+			if !slices.Contains(*tried, substituter) {
+				rest = append(rest, substituter)
+			}
+		}
+		if len(rest) == 0 {
+			return StorePath{}, false
+		}
+		next, err := d.fetchNarInfoFrom(sp.BasePath, rest)
+		if err != nil {
+			logf(1, "No other substituter to fetch %s from: %v", sp.BasePath, err)
+			return StorePath{}, false
+		}
+		*tried = append(*tried, next.Substituter)
+		// A rebuild with different contents could also differ in its
+		// references
+		if next.NarHash == sp.NarHash {
+			return next, true
+		}
+		log.Printf("Warning: %s has a different NarHash on %s, not retrying from it", sp.BasePath, next.Substituter)
+	}
+}
+
+var supportedCompressions = []string{"none", "gzip", "xz", "zstd"}
+
+// narMagic is the start of an uncompressed NAR, the string nix-archive-1.
+var narMagic = append([]byte{13, 0, 0, 0, 0, 0, 0, 0}, "nix-archive-1"...)
+
+// sniffCompression detects the compression of a NAR from its first bytes.
+func sniffCompression(header []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(header, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return "xz", nil
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "zstd", nil
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return "gzip", nil
+	case bytes.HasPrefix(header, narMagic):
+		return "none", nil
+	default:
+		return "", fmt.Errorf("unknown compression of NAR starting with %x", header[:min(len(header), 8)])
+	}
+}
+
+// narBody returns the NAR file served in resp for sp. The transport of
+// NarClient does not ask for compressed responses, so the narinfo Compression
+// alone describes the body. If a server sets a gzip Content-Encoding anyway,
+// that layer is removed unless the body already is in the format of the
+// narinfo, as served by caches labelling their .nar.gz files that way.
+func narBody(resp *http.Response, sp StorePath) (io.Reader, error) {
+	body := meteredReader{resp.Body}
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding == "" || encoding == "identity" {
+		return body, nil
+	}
+	if encoding != "gzip" && encoding != "x-gzip" {
+		return nil, fmt.Errorf("unsupported Content-Encoding of NAR: %s", encoding)
+	}
+	br := bufio.NewReader(body)
+	header, _ := br.Peek(len(narMagic))
+	if compression, err := sniffCompression(header); err != nil || compression != "gzip" || sp.Compression == "gzip" {
+		logf(2, "Ignoring Content-Encoding %s of %s, the NAR is sent as is", encoding, sp.NarURL)
+		return br, nil
+	}
+	logf(1, "Removing Content-Encoding %s of %s", encoding, sp.NarURL)
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Encoding %s: %w", encoding, err)
+	}
+	return gz, nil
+}
+
+// sniffFileCompression detects the compression of the NAR stored in f.
+func sniffFileCompression(f *os.File) (string, error) {
+	header := make([]byte, len(narMagic))
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return sniffCompression(header[:n])
+}
+
+func (d *Downloader) fetchAndManifestStorePath(destPath string, sp StorePath) error {
+	start := time.Now()
+
+	if offline && !isLocalURL(sp.NarURL) {
+		return fmt.Errorf("offline: NAR %s requires a network fetch", sp.NarURL)
+	}
+
+	release, err := acquireNarMemory(sp)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	pt := newPathTiming(sp.BasePath)
+	defer pt.finish(time.Now())
+
+	// Fetch the NAR, reusing the files of the -base path if possible
+	requestStart := time.Now()
+	var nar io.ReadCloser
+	var mismatch string
+	if _, ok := deltaTargets[sp.BasePath]; ok && deltaBase != "" {
+		f, err := d.fetchNarDelta(sp)
+		if err != nil {
+			logf(1, "Delta download of %s failed, downloading it in full: %v", sp.BasePath, err)
+		} else {
+			nar = f
+		}
+	}
+	if nar == nil {
+		resp, err := httpGet(d.NarClient, sp.NarURL)
+		if err != nil {
+			return fmt.Errorf("failed to fetch NAR: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return &httpStatusError{"NAR", resp.Status}
+		}
+		body, err := narBody(resp, sp)
 		if err != nil {
+			resp.Body.Close()
 			return err
 		}
+		nar = struct {
+			io.Reader
+			io.Closer
+		}{body, resp.Body}
+		mismatch = servedNarMismatch(sp)
+	}
+	defer nar.Close()
+	pt.add(phaseRequest, requestStart)
+
+	if err := d.manifestNar(destPath, sp, nar, mismatch, pt); err != nil {
+		return err
+	}
+	logf(2, "Fetched %s in %s", sp.BasePath, time.Since(start))
+
+	if postExtract != "" {
+		postExtractStart := time.Now()
+		err := runPostExtract(destPath)
+		pt.add(phasePostExtract, postExtractStart)
+		if err != nil {
+			return fmt.Errorf("post-extract command failed: %w", err)
+		}
 	}
 
 	return nil
 }
 
-func fetchAndManifestStorePath(destPath string, sp StorePath) error {
+// manifestNar extracts the compressed NAR of sp read from nar to destPath in
+// the store through a temporary directory, verifying its NarHash before the
+// directory is renamed into place. mismatch is the result of
+// servedNarMismatch for a fetched NAR. With -into the NAR is extracted
+// directly into the existing empty directory destPath instead. The phases are
+// timed in pt for -trace-timing.
+func (d *Downloader) manifestNar(destPath string, sp StorePath, nar io.Reader, mismatch string, pt *pathTiming) error {
 	// Create a temporary directory
-	tempDir := filepath.Join(nixStore, ".nix-download_"+sp.BasePath)
+	tempDir := d.tempDir(sp.BasePath)
+	if intoDir != "" {
+		tempDir = destPath
+		if err := checkEmptyDir(tempDir); err != nil {
+			return err
+		}
+	}
+	extracted := false
 	defer func() {
-		// Clean up the temporary directory if something goes wrong
-		if _, err := os.Stat(tempDir); err == nil {
+		// Clean up the temporary directory if something goes wrong, the
+		// directory of -into is only emptied
+		if intoDir != "" {
+			if !extracted {
+				clearDir(tempDir)
+			}
+		} else if _, err := os.Stat(tempDir); err == nil {
 			os.RemoveAll(tempDir)
 		}
 	}()
 
-	// Fetch the NAR
-	resp, err := narClient.Get(sp.NarURL)
+	var body io.Reader = pt.reader(phaseRead, nar)
+	var kept *keptNar
+	if keepNarDir != "" {
+		var err error
+		kept, err = newKeptNar(body, sp, mismatch)
+		if err != nil {
+			return err
+		}
+		defer kept.Close()
+		body = kept.Body
+	}
+
+	br := bufio.NewReaderSize(body, readBufferSize)
+	compression := narCompression(br, sp, mismatch)
+	logf(2, "Decompressing %s with %s", sp.BasePath, compression)
+	decompressStart := time.Now()
+	reader, closeReader, err := decompress(br, compression)
+	pt.add(phaseDecompress, decompressStart)
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+
+	// Cap the decompressed size at NarSize to avoid DOS
+	var limitedReader io.Reader = newNarSizeReader(pt.reader(phaseDecompress, reader), sp.NarSize)
+	if progress.w != nil {
+		limitedReader = &progressReader{r: limitedReader, path: destPath, total: sp.NarSize}
+	}
+
+	// Decompress in a separate goroutine to overlap it with writing the
+	// files, the hasher sees the stream as it is extracted
+	source, _ := nar.(io.Closer)
+	pipelined, stopPipeline := pipelineReader(limitedReader, source)
+	defer stopPipeline()
+
+	var narHasher interface {
+		io.Writer
+		Sum() []byte
+	} = syncHasher{sha256.New()}
+	if runtime.NumCPU() > 1 && sp.NarSize >= asyncHashMinSize {
+		ah := newAsyncHasher()
+		defer ah.Close()
+		narHasher = ah
+	}
+
+	teeReader := io.TeeReader(pt.reader(phaseWait, pipelined), pt.writer(phaseHash, narHasher))
+
+	// Extract the NAR to the temporary directory
+	extractor, err := narextract.NewNarExtractor(teeReader, tempDir)
 	if err != nil {
-		return fmt.Errorf("failed to fetch NAR: %w", err)
+		return fmt.Errorf("failed to create NAR extractor: %w", err)
+	}
+	extractor.SetMaxSize(sp.NarSize)
+	extractor.SetIntoExisting(intoDir != "")
+	extractStart := time.Now()
+	if err := extractor.Extract(); err != nil {
+		return fmt.Errorf("failed to extract NAR: %w", err)
+	}
+	if err := checkNarEnd(teeReader, br); err != nil {
+		return fmt.Errorf("failed to extract NAR: %w", err)
+	}
+	pt.add(phaseExtract, extractStart)
+
+	// Verify the hash
+	computedHash := "sha256:" + nixBase32Encode(narHasher.Sum())
+	if computedHash != sp.NarHash {
+		return fmt.Errorf("%w: expected %s, got %s", errHashMismatch, sp.NarHash, computedHash)
+	}
+	logf(2, "Verified %s: %s", sp.BasePath, computedHash)
+
+	if kept != nil {
+		if err := kept.Finish(sp); err != nil {
+			return fmt.Errorf("failed to keep NAR: %w", err)
+		}
+	}
+
+	if optimise {
+		optimiseStart := time.Now()
+		if err := d.optimisePath(tempDir, extractor.Listing()); err != nil {
+			return fmt.Errorf("failed to optimise: %w", err)
+		}
+		pt.add(phaseOptimise, optimiseStart)
+	}
+
+	if intoDir != "" {
+		extracted = true
+	} else {
+		// Move the temporary directory to the final destination. The corrupt
+		// copy found by -paranoid is only replaced now that its replacement
+		// is verified.
+		renameStart := time.Now()
+		if _, ok := corruptPaths[sp.BasePath]; ok {
+			if err := replacePath(tempDir, destPath); err != nil {
+				return fmt.Errorf("failed to replace corrupt path: %w", err)
+			}
+		} else if err := moveIntoPlace(tempDir, destPath); err != nil {
+			return fmt.Errorf("failed to move temporary directory to final destination: %w", err)
+		}
+		pt.add(phaseRename, renameStart)
+	}
+
+	if listingDir != "" {
+		if err := writeListing(sp, extractor.Listing()); err != nil {
+			return fmt.Errorf("failed to write listing: %w", err)
+		}
+	}
+	return nil
+}
+
+// asyncHashMinSize is the NarSize from which hashing is moved to a separate
+// goroutine, below it handing over the data costs more than it saves.
+var asyncHashMinSize int64 = 4 * 1024 * 1024
+
+// asyncHasher computes a sha256 in a separate goroutine so that hashing
+// overlaps with extracting on machines with several cores. Written data is
+// copied into buffers that are reused once hashed.
+type asyncHasher struct {
+	ch    chan []byte
+	free  chan []byte
+	done  chan struct{}
+	once  sync.Once
+	state hash.Hash
+}
+
+// syncHasher hashes in the goroutine writing the data.
+type syncHasher struct {
+	hash.Hash
+}
+
+func (sh syncHasher) Sum() []byte {
+	return sh.Hash.Sum(nil)
+}
+
+func newAsyncHasher() *asyncHasher {
+	ah := &asyncHasher{
+		ch:    make(chan []byte, 4),
+		free:  make(chan []byte, 6),
+		done:  make(chan struct{}),
+		state: sha256.New(),
+	}
+	go func() {
+		defer close(ah.done)
+		for buf := range ah.ch {
+			ah.state.Write(buf)
+			select {
+			case ah.free <- buf:
+			default:
+			}
+		}
+	}()
+	return ah
+}
+
+func (ah *asyncHasher) Write(p []byte) (int, error) {
+	var buf []byte
+	select {
+	case buf = <-ah.free:
+	default:
+		buf = make([]byte, 0, max(len(p), pipelineBufferSize))
+	}
+	ah.ch <- append(buf[:0], p...)
+	return len(p), nil
+}
+
+// Close stops the hashing goroutine, it must be called even if Sum is not.
+func (ah *asyncHasher) Close() {
+	ah.once.Do(func() { close(ah.ch) })
+	<-ah.done
+}
+
+// Sum waits until all data written is hashed and returns the hash.
+func (ah *asyncHasher) Sum() []byte {
+	ah.Close()
+	return ah.state.Sum(nil)
+}
+
+// pipelineBufferSize is the size of the chunks passed from the decompressing
+// goroutine to the extraction.
+const pipelineBufferSize = 256 * 1024
+
+// pipelineReader reads r in a separate goroutine and returns a reader for
+// its data. An error reading r is returned by the reader. The returned
+// function stops the goroutine, it must be called before r is released. If
+// the goroutine has not finished reading r by then, source, the stream r
+// reads from, is closed to interrupt a pending read, e.g. of a stalled
+// response.
+func pipelineReader(r io.Reader, source io.Closer) (io.Reader, func()) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := io.CopyBuffer(pw, r, make([]byte, pipelineBufferSize))
+		pw.CloseWithError(err)
+	}()
+	return pr, func() {
+		pr.Close()
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if source != nil {
+			source.Close()
+		}
+		<-done
+	}
+}
+
+// decompress returns a reader decompressing reader according to the narinfo
+// Compression field and a function releasing its resources.
+func decompress(reader io.Reader, compression string) (io.Reader, func(), error) {
+	if compression == "unknown" {
+		br, ok := reader.(*bufio.Reader)
+		if !ok {
+			br = bufio.NewReader(reader)
+		}
+		reader = br
+		// Peek fails for short streams, which sniffCompression rejects
+		header, _ := br.Peek(len(narMagic))
+		var err error
+		if compression, err = sniffCompression(header); err != nil {
+			return nil, nil, err
+		}
+		logf(1, "Detected %s compression", compression)
 	}
-	defer resp.Body.Close()
 
-	reader := io.Reader(bufio.NewReaderSize(resp.Body, 64*1024))
-	switch sp.Compression {
+	switch compression {
 	case "none":
+		return reader, func() {}, nil
 	case "gzip":
 		gzReader, err := gzip.NewReader(reader)
 		if err != nil {
-			return fmt.Errorf("failed to create gzip reader: %w", err)
+			return nil, nil, fmt.Errorf("failed to create gzip reader: %w", err)
 		}
-		defer gzReader.Close()
-		reader = gzReader
+		// Stop at the end of the stream, anything after it is trailing data
+		gzReader.Multistream(false)
+		return gzReader, func() { gzReader.Close() }, nil
 	case "xz":
-		xzReader, err := xz.NewReader(reader)
+		xzReader, err := xz.ReaderConfig{SingleStream: true}.NewReader(newXzDictChecker(reader))
 		if err != nil {
-			return fmt.Errorf("failed to create xz reader: %w", err)
+			return nil, nil, fmt.Errorf("failed to create xz reader: %w", err)
 		}
-		reader = xzReader
+		return xzReader, func() {}, nil
 	case "zstd":
-		zstdReader, err := zstd.NewReader(reader)
+		br, ok := reader.(*bufio.Reader)
+		if !ok {
+			br = bufio.NewReader(reader)
+		}
+		options, err := zstdDecoderOptions(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		zstdReader, err := zstd.NewReader(br, options...)
 		if err != nil {
-			return fmt.Errorf("failed to create zstd reader: %w", err)
+			return nil, nil, fmt.Errorf("failed to create zstd reader: %w", err)
 		}
-		defer zstdReader.Close()
-		reader = zstdReader
+		return zstdReader, zstdReader.Close, nil
 	default:
-		return fmt.Errorf("unsupported compression type: %s", sp.Compression)
+		return nil, nil, fmt.Errorf("unsupported compression type: %s", compression)
 	}
+}
 
-	// Wrap the reader with a LimitReader to avoid DOS
-	limitedReader := io.LimitReader(reader, sp.NarSize)
-
-	narHasher := sha256.New()
-
-	teeReader := io.TeeReader(limitedReader, narHasher)
+// runPostExtract runs the -post-extract command for destPath, which is passed
+// as the last argument and in $NIX_DOWNLOAD_PATH.
+func runPostExtract(destPath string) error {
+	args := append(strings.Fields(postExtract), destPath)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "NIX_DOWNLOAD_PATH="+destPath)
+	// Keep stdout reserved for the list of paths
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
 
-	// Extract the NAR to the temporary directory
-	extractor, err := narextract.NewNarExtractor(teeReader, tempDir)
+// writeListing writes a .ls file in the format used by Nix binary caches. It
+// is not compressed: Nix only decompresses listings served with a
+// Content-Encoding, which a directory of files served as is does not have.
+func writeListing(sp StorePath, root *narextract.Entry) error {
+	hash, _, _ := strings.Cut(sp.BasePath, "-")
+	data, err := json.Marshal(narextract.NewListing(root))
 	if err != nil {
-		return fmt.Errorf("failed to create NAR extractor: %w", err)
+		return err
 	}
-	if err := extractor.Extract(); err != nil {
-		return fmt.Errorf("failed to extract NAR: %w", err)
+	if err := os.MkdirAll(listingDir, 0755); err != nil {
+		return err
 	}
+	return os.WriteFile(filepath.Join(listingDir, hash+".ls"), data, 0644)
+}
 
-	// Verify the hash
-	computedHash := "sha256:" + nixBase32Encode(narHasher.Sum(nil))
-	if computedHash != sp.NarHash {
-		return fmt.Errorf("hash mismatch: expected %s, got %s", sp.NarHash, computedHash)
+// normalizeSubstituter validates a substituter URL and strips trailing
+// slashes, so that URLs can be built by appending "/" and a relative path.
+func normalizeSubstituter(substituter string) (string, error) {
+	u, err := url.Parse(substituter)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return "", fmt.Errorf("missing host")
+		}
+	case "file":
+	default:
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("query and fragment are not supported")
 	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+func isLocalURL(u string) bool {
+	return strings.HasPrefix(u, "file://")
+}
 
-	// Move the temporary directory to the final destination
-	if err := os.Rename(tempDir, destPath); err != nil {
-		return fmt.Errorf("failed to move temporary directory to final destination: %w", err)
+// logf logs to stderr if the verbosity is at least level.
+func logf(level int, format string, args ...any) {
+	if verbosity >= level {
+		log.Printf(format, args...)
 	}
+}
+
+// verbosityFlag is a boolean flag that raises the verbosity by step each time
+// it is given.
+type verbosityFlag struct {
+	level *int
+	step  int
+}
+
+func (v verbosityFlag) IsBoolFlag() bool {
+	return true
+}
 
+func (v verbosityFlag) String() string {
+	return "false"
+}
+
+func (v verbosityFlag) Set(value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	if b {
+		*v.level += v.step
+	}
 	return nil
 }
 
@@ -442,3 +2412,28 @@ func nixBase32Encode(hash []byte) string {
 
 	return string(s)
 }
+
+// nixBase32Decode is the inverse of nixBase32Encode.
+func nixBase32Decode(s string) ([]byte, error) {
+	hashSize := len(s) * 5 / 8
+	hash := make([]byte, hashSize)
+
+	for n := 0; n < len(s); n++ {
+		digit := strings.IndexByte(nix32Chars, s[len(s)-1-n])
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid character in nix base32 string: %q", s[len(s)-1-n])
+		}
+		b := n * 5
+		i := b / 8
+		j := b % 8
+		hash[i] |= byte(digit << j)
+		carry := byte(digit >> (8 - j))
+		if i+1 < hashSize {
+			hash[i+1] |= carry
+		} else if carry != 0 {
+			return nil, fmt.Errorf("invalid nix base32 string: %s", s)
+		}
+	}
+
+	return hash, nil
+}
@@ -0,0 +1,1559 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/simonfxr/nix-download/narextract"
+	"github.com/ulikunitz/xz"
+)
+
+// testKey signs the narinfos of the test caches, otherKey is not trusted.
+var (
+	testKey  = secretKey{name: "test-1", key: ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))}
+	otherKey = secretKey{name: "other-1", key: ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize))}
+)
+
+const (
+	topPath = "0000000000000000000000000000000a-top-1.0"
+	depPath = "0000000000000000000000000000000b-dep-1.0"
+)
+
+// testCache is a binary cache served by an httptest.Server, files maps the
+// URL paths to their contents.
+type testCache struct {
+	*httptest.Server
+	mu    sync.Mutex
+	files map[string][]byte
+	// handle, if set with setHandle, is called for each request first and
+	// reports whether it handled it
+	handle func(w http.ResponseWriter, r *http.Request) bool
+}
+
+func newTestCache(t testing.TB) *testCache {
+	c := &testCache{files: map[string][]byte{
+		"/nix-cache-info": []byte("StoreDir: " + storeDir + "\n"),
+	}}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		handle := c.handle
+		c.mu.Unlock()
+		if handle != nil && handle(w, r) {
+			return
+		}
+		c.mu.Lock()
+		data, ok := c.files[r.URL.Path]
+		c.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// testPath is a store path with the files of its tree, which maps the
+// relative names to their contents. Names ending in * are executable and
+// contents starting with -> are symlink targets.
+type testPath struct {
+	base       string
+	references []string
+	tree       map[string]string
+}
+
+// narOf returns the NAR serialisation of the tree of p.
+func narOf(t testing.TB, p testPath) []byte {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), p.base)
+	writeTree(t, dir, p.tree)
+	var nar bytes.Buffer
+	writeNarString(&nar, "nix-archive-1")
+	if err := writeNarNode(&nar, dir); err != nil {
+		t.Fatal(err)
+	}
+	return nar.Bytes()
+}
+
+func writeTree(t testing.TB, dir string, tree map[string]string) {
+	t.Helper()
+	for name, contents := range tree {
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(name, "*") {
+			name, mode = strings.TrimSuffix(name, "*"), 0755
+		}
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if target, ok := strings.CutPrefix(contents, "->"); ok {
+			err = os.Symlink(target, path)
+		} else {
+			err = os.WriteFile(path, []byte(contents), mode)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func compressNar(t testing.TB, nar []byte, compression string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	switch compression {
+	case "none":
+		return nar
+	case "gzip":
+		w := gzip.NewWriter(&buf)
+		w.Write(nar)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case "xz":
+		w, err := xz.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(nar)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case "zstd":
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.EncodeAll(nar, nil)
+	default:
+		t.Fatalf("unsupported compression %s", compression)
+	}
+	return buf.Bytes()
+}
+
+func nixHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + nixBase32Encode(sum[:])
+}
+
+// narInfoKeys are the fields of the narinfos served by testCache in order.
+var narInfoKeys = []string{"StorePath", "URL", "Compression", "FileHash", "FileSize", "NarHash", "NarSize", "References"}
+
+// narInfoText formats narInfo and signs it with sk.
+func narInfoText(narInfo map[string]string, sk secretKey) []byte {
+	var text []byte
+	for _, key := range narInfoKeys {
+		text = fmt.Appendf(text, "%s: %s\n", key, narInfo[key])
+	}
+	return appendSig(text, narInfo, sk)
+}
+
+// setHandle makes c call handle for each request first. Setting it under the
+// lock also orders it after the state handle uses for the race detector,
+// which does not see the requests of the processes started by runMain.
+func (c *testCache) setHandle(handle func(w http.ResponseWriter, r *http.Request) bool) {
+	c.mu.Lock()
+	c.handle = handle
+	c.mu.Unlock()
+}
+
+// setNarInfo serves text as the narinfo of base.
+func (c *testCache) setNarInfo(base string, text []byte) {
+	hash, _, _ := strings.Cut(base, "-")
+	c.mu.Lock()
+	c.files["/"+hash+".narinfo"] = text
+	c.mu.Unlock()
+}
+
+// add serves p compressed with compression, its narinfo is signed with sk
+// and declares narHash unless that is empty. corrupt modifies the served
+// NAR after its FileHash is computed. It returns the fields of the narinfo,
+// which can be changed and served again with setNarInfo.
+func (c *testCache) add(t testing.TB, p testPath, compression string, sk secretKey, narHash string, corrupt func([]byte)) map[string]string {
+	t.Helper()
+	nar := narOf(t, p)
+	file := compressNar(t, nar, compression)
+	if narHash == "" {
+		narHash = nixHash(nar)
+	}
+	ext, err := compressionExtension(compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileHash := nixHash(file)
+	narURL := "nar/" + strings.TrimPrefix(fileHash, "sha256:") + ".nar" + ext
+
+	narInfo := map[string]string{
+		"StorePath":   storeDir + "/" + p.base,
+		"URL":         narURL,
+		"Compression": compression,
+		"FileHash":    fileHash,
+		"FileSize":    fmt.Sprint(len(file)),
+		"NarHash":     narHash,
+		"NarSize":     fmt.Sprint(len(nar)),
+		"References":  strings.Join(p.references, " "),
+	}
+	if corrupt != nil {
+		file = bytes.Clone(file)
+		corrupt(file)
+	}
+	c.setNarInfo(p.base, narInfoText(narInfo, sk))
+	c.mu.Lock()
+	c.files["/"+narURL] = file
+	c.mu.Unlock()
+	return narInfo
+}
+
+// setFlag sets the flag variable p to v for the duration of the test.
+func setFlag[T any](t testing.TB, p *T, v T) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+func newTestDownloader(t testing.TB, caches ...*testCache) *Downloader {
+	t.Helper()
+	// Keep the fetched paths out of the test output
+	setFlag(t, &quiet, true)
+	d := &Downloader{
+		NixStore:      t.TempDir(),
+		KnownKeys:     map[string]ed25519.PublicKey{testKey.name: testKey.key.Public().(ed25519.PublicKey)},
+		NarInfoClient: &http.Client{CheckRedirect: checkRedirect},
+		NarClient:     &http.Client{CheckRedirect: checkRedirect},
+	}
+	for _, c := range caches {
+		substituter, err := normalizeSubstituter(c.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Substituters = append(d.Substituters, substituter)
+	}
+	return d
+}
+
+// testBase returns the base name of the i-th of a number of test paths.
+func testBase(i int) string {
+	return fmt.Sprintf("%031dc-path-%d", i, i)
+}
+
+// checkTree checks that the store path base of d has the files of tree and
+// no others.
+func checkTree(t *testing.T, d *Downloader, base string, tree map[string]string) {
+	t.Helper()
+	want := filepath.Join(t.TempDir(), base)
+	writeTree(t, want, tree)
+	var wantNar, gotNar bytes.Buffer
+	if err := writeNarNode(&wantNar, want); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeNarNode(&gotNar, filepath.Join(d.NixStore, base)); err != nil {
+		t.Fatalf("%s: %v", base, err)
+	}
+	if !bytes.Equal(gotNar.Bytes(), wantNar.Bytes()) {
+		t.Errorf("%s was not extracted as expected", base)
+	}
+}
+
+var (
+	topTree = map[string]string{
+		"bin/top*":            "#!/bin/sh\necho top\n",
+		"lib/libtop.so":       strings.Repeat("library ", 10000),
+		"share/doc/README":    "top\n",
+		"share/doc/dep":       "->../../lib/libtop.so",
+		"share/empty/.keep":   "",
+		"share/man/man1/top1": "manual\n",
+	}
+	depTree = map[string]string{"dep": "dep\n"}
+)
+
+func TestDownloadCompressions(t *testing.T) {
+	for _, compression := range supportedCompressions {
+		t.Run(compression, func(t *testing.T) {
+			c := newTestCache(t)
+			c.add(t, testPath{base: topPath, references: []string{depPath, topPath}, tree: topTree}, compression, testKey, "", nil)
+			c.add(t, testPath{base: depPath, tree: depTree}, compression, testKey, "", nil)
+			d := newTestDownloader(t, c)
+
+			cl, err := d.discoverDependencies([]string{topPath})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cl.StorePaths) != 2 {
+				t.Fatalf("discovered %d paths, want 2", len(cl.StorePaths))
+			}
+			for _, sp := range cl.StorePaths {
+				if sp.Compression != compression {
+					t.Errorf("%s has compression %s, want %s", sp.BasePath, sp.Compression, compression)
+				}
+			}
+			if _, err := d.fetchAndManifestStorePaths(cl.StorePaths); err != nil {
+				t.Fatal(err)
+			}
+			checkTree(t, d, topPath, topTree)
+			checkTree(t, d, depPath, depTree)
+			for _, sp := range cl.StorePaths {
+				if err := d.checkPathNar(sp); err != nil {
+					t.Errorf("%s: %v", sp.BasePath, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadFallsBackOnCorruptNar(t *testing.T) {
+	corrupt := newTestCache(t)
+	good := newTestCache(t)
+	p := testPath{base: depPath, tree: depTree}
+	corrupt.add(t, p, "none", testKey, "", func(nar []byte) { nar[len(nar)-20] ^= 1 })
+	good.add(t, p, "none", testKey, "", nil)
+	d := newTestDownloader(t, corrupt, good)
+
+	cl, err := d.discoverDependencies([]string{depPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cl.StorePaths) != 1 || cl.StorePaths[0].Substituter != d.Substituters[0] {
+		t.Fatalf("discovered %v, want %s from %s", cl.StorePaths, depPath, d.Substituters[0])
+	}
+	sp, err := d.fetchWithFallback(d.fetchAndManifestStorePath, filepath.Join(d.NixStore, depPath), cl.StorePaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.Substituter != d.Substituters[1] {
+		t.Errorf("fetched from %s, want %s", sp.Substituter, d.Substituters[1])
+	}
+	checkTree(t, d, depPath, depTree)
+}
+
+func TestDownloadRejectsUntrustedSignature(t *testing.T) {
+	c := newTestCache(t)
+	c.add(t, testPath{base: depPath, tree: depTree}, "xz", otherKey, "", nil)
+	d := newTestDownloader(t, c)
+
+	_, err := d.discoverDependencies([]string{depPath})
+	if exitCode(err) != exitVerification {
+		t.Fatalf("got error %v with exit status %d, want exit status %d", err, exitCode(err), exitVerification)
+	}
+	if _, err := os.Lstat(filepath.Join(d.NixStore, depPath)); !os.IsNotExist(err) {
+		t.Errorf("%s was created: %v", depPath, err)
+	}
+}
+
+func TestDownloadRejectsHashMismatch(t *testing.T) {
+	for _, compression := range supportedCompressions {
+		t.Run(compression, func(t *testing.T) {
+			c := newTestCache(t)
+			// The narinfo is signed, but for other contents
+			wrongHash := nixHash([]byte("other contents"))
+			c.add(t, testPath{base: depPath, tree: depTree}, compression, testKey, wrongHash, nil)
+			d := newTestDownloader(t, c)
+
+			cl, err := d.discoverDependencies([]string{depPath})
+			if err != nil {
+				t.Fatal(err)
+			}
+			destPath := filepath.Join(d.NixStore, depPath)
+			_, err = d.fetchWithFallback(d.fetchAndManifestStorePath, destPath, cl.StorePaths[0])
+			if exitCode(err) != exitHashMismatch {
+				t.Fatalf("got error %v with exit status %d, want exit status %d", err, exitCode(err), exitHashMismatch)
+			}
+			if _, err := os.Lstat(destPath); !os.IsNotExist(err) {
+				t.Errorf("%s was created: %v", depPath, err)
+			}
+		})
+	}
+}
+
+func TestDownloadReleasesSubstituterSlotsOnFailure(t *testing.T) {
+	setFlag(t, &jobs, 4)
+	setFlag(t, &perSubstituterJobs, 1)
+	c := newTestCache(t)
+	var roots []string
+	for i := range 8 {
+		c.add(t, testPath{base: testBase(i), tree: depTree}, "none", testKey, "", nil)
+		roots = append(roots, testBase(i))
+	}
+	d := newTestDownloader(t, c)
+	cl, err := d.discoverDependencies(roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first path fails, the later ones are dropped
+	cl.StorePaths[0].NarHash = nixHash([]byte("other contents"))
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := d.fetchAndManifestStorePaths(cl.StorePaths)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if exitCode(err) != exitHashMismatch {
+			t.Fatalf("got error %v, want a hash mismatch", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("downloads did not finish after a failure")
+	}
+	narSlots.Lock()
+	defer narSlots.Unlock()
+	if n := narSlots.inUse[d.Substituters[0]]; n != 0 {
+		t.Errorf("%d slots still in use", n)
+	}
+}
+
+func TestNarInfoURLMustStayInSubstituter(t *testing.T) {
+	for _, tc := range []struct {
+		url     string
+		wantErr bool
+	}{
+		{"http://evil/x", true},
+		{"../../etc", true},
+		{"nar/../../etc", true},
+		{"/etc/passwd", true},
+		{"//evil/x", true},
+		// The relative URL the NAR is served at
+		{"", false},
+	} {
+		c := newTestCache(t)
+		narInfo := c.add(t, testPath{base: depPath, tree: depTree}, "xz", testKey, "", nil)
+		narURL := narInfo["URL"]
+		if tc.url != "" {
+			narInfo["URL"] = tc.url
+			c.setNarInfo(depPath, narInfoText(narInfo, testKey))
+		}
+		d := newTestDownloader(t, c)
+
+		cl, err := d.discoverDependencies([]string{depPath})
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("URL %q: discovered %s with NAR URL %s", tc.url, depPath, cl.StorePaths[0].NarURL)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("URL %q: %v", narURL, err)
+		}
+		if got, want := cl.StorePaths[0].NarURL, c.URL+"/"+narURL; got != want {
+			t.Errorf("URL %q resolved to %s, want %s", narURL, got, want)
+		}
+		if _, err := d.fetchAndManifestStorePaths(cl.StorePaths); err != nil {
+			t.Fatal(err)
+		}
+		checkTree(t, d, depPath, depTree)
+	}
+}
+
+func TestDownloadRejectsInvalidReferences(t *testing.T) {
+	for _, ref := range []string{
+		"../../etc/passwd",
+		"/nix/store/" + depPath,
+		"0000000000000000000000000000000-short",
+		"0000000000000000000000000000000e-invalid-base32",
+		"0000000000000000000000000000000b-",
+	} {
+		c := newTestCache(t)
+		narInfo := c.add(t, testPath{base: topPath, tree: topTree}, "xz", testKey, "", nil)
+		narInfo["References"] = ref
+		c.setNarInfo(topPath, narInfoText(narInfo, testKey))
+		d := newTestDownloader(t, c)
+
+		if _, err := d.discoverDependencies([]string{topPath}); err == nil || !strings.Contains(err.Error(), "invalid reference") {
+			t.Errorf("reference %q: got error %v, want an invalid reference", ref, err)
+		}
+		if entries, _ := os.ReadDir(d.NixStore); len(entries) > 0 {
+			t.Errorf("reference %q: %s was written to", ref, d.NixStore)
+		}
+	}
+}
+
+func TestDownloadMislabelledCompression(t *testing.T) {
+	for _, tc := range []struct {
+		// served is the compression of the NAR file, declared that of the
+		// narinfo and ext the extension of its URL
+		served, declared, ext string
+	}{
+		{"xz", "xz", ".nar.zst"},
+		{"xz", "none", ".nar.xz"},
+		{"none", "xz", ".nar"},
+		{"zstd", "gzip", ".nar.zst"},
+	} {
+		t.Run(fmt.Sprintf("%s as %s at %s", tc.served, tc.declared, tc.ext), func(t *testing.T) {
+			c := newTestCache(t)
+			narInfo := c.add(t, testPath{base: depPath, tree: depTree}, tc.served, testKey, "", nil)
+			c.mu.Lock()
+			file := c.files["/"+narInfo["URL"]]
+			narInfo["URL"] = "nar/mislabelled" + tc.ext
+			c.files["/"+narInfo["URL"]] = file
+			c.mu.Unlock()
+			narInfo["Compression"] = tc.declared
+			c.setNarInfo(depPath, narInfoText(narInfo, testKey))
+			d := newTestDownloader(t, c)
+
+			cl, err := d.discoverDependencies([]string{depPath})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sp := cl.StorePaths[0]
+			if err := d.fetchAndManifestStorePath(filepath.Join(d.NixStore, depPath), sp); err != nil {
+				t.Errorf("extracting: %v", err)
+			} else {
+				checkTree(t, d, depPath, depTree)
+			}
+
+			f, err := d.fetchNarToFile(filepath.Join(d.NixStore, depPath), sp)
+			if err != nil {
+				t.Errorf("exporting: %v", err)
+			} else {
+				f.Close()
+			}
+
+			setFlag(t, &downloadOnlyDir, t.TempDir())
+			if err := initBinaryCacheDir(downloadOnlyDir); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.downloadNar(sp); err != nil {
+				t.Errorf("downloading: %v", err)
+			}
+		})
+	}
+}
+
+func TestDownloadStopsOnExtractionErrorWithStalledServer(t *testing.T) {
+	c := newTestCache(t)
+	narInfo := c.add(t, testPath{base: depPath, tree: depTree}, "none", testKey, "", nil)
+	narInfo["NarSize"] = fmt.Sprint(1 << 20)
+	c.setNarInfo(depPath, narInfoText(narInfo, testKey))
+	// The NAR fails to extract right away, then the server stalls
+	stalled := make(chan struct{})
+	t.Cleanup(func() { close(stalled) })
+	c.setHandle(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/"+narInfo["URL"] {
+			return false
+		}
+		for _, token := range []string{"nix-archive-1", "(", "type", "bogus"} {
+			writeNarString(w, token)
+		}
+		w.(http.Flusher).Flush()
+		select {
+		case <-stalled:
+		case <-r.Context().Done():
+		}
+		return true
+	})
+	d := newTestDownloader(t, c)
+	cl, err := d.discoverDependencies([]string{depPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- d.fetchAndManifestStorePath(filepath.Join(d.NixStore, depPath), cl.StorePaths[0])
+	}()
+	select {
+	case err := <-result:
+		if err == nil || !strings.Contains(err.Error(), "unknown object type") {
+			t.Fatalf("got error %v, want an extraction error", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("extraction error did not stop the download")
+	}
+}
+
+// benchmarkTree returns a tree of files of a total size of 64 MiB, which
+// compress about 2:1.
+func benchmarkTree() map[string]string {
+	rng := rand.New(rand.NewSource(1))
+	tree := map[string]string{}
+	for i := range 16 {
+		data := make([]byte, 4<<20)
+		for j := range data {
+			data[j] = "abcdefghijklmnop"[rng.Intn(16)]
+		}
+		tree[fmt.Sprintf("lib/file%d", i)] = string(data)
+	}
+	return tree
+}
+
+// BenchmarkExtractPipeline compares extracting a zstd compressed NAR with
+// the decompression in the same goroutine and pipelined as by manifestNar.
+func BenchmarkExtractPipeline(b *testing.B) {
+	nar := narOf(b, testPath{base: depPath, tree: benchmarkTree()})
+	file := compressNar(b, nar, "zstd")
+	for _, pipelined := range []bool{false, true} {
+		b.Run(map[bool]string{false: "sync", true: "pipelined"}[pipelined], func(b *testing.B) {
+			b.SetBytes(int64(len(nar)))
+			dir := filepath.Join(b.TempDir(), depPath)
+			for range b.N {
+				reader, closeReader, err := decompress(bytes.NewReader(file), "zstd")
+				if err != nil {
+					b.Fatal(err)
+				}
+				stop := func() {}
+				if pipelined {
+					reader, stop = pipelineReader(reader, nil)
+				}
+				ne, err := narextract.NewNarExtractor(reader, dir)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := ne.Extract(); err != nil {
+					b.Fatal(err)
+				}
+				stop()
+				closeReader()
+				b.StopTimer()
+				os.RemoveAll(dir)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// BenchmarkDownloadHashing downloads small and large NARs from a test cache
+// with the NarHash computed inline and in a separate goroutine. The
+// goroutine only pays off with more than one CPU.
+func BenchmarkDownloadHashing(b *testing.B) {
+	for _, size := range []struct {
+		name string
+		tree map[string]string
+	}{
+		{"small", depTree},
+		{"large", benchmarkTree()},
+	} {
+		for _, async := range []bool{false, true} {
+			b.Run(size.name+map[bool]string{false: "/inline", true: "/async"}[async], func(b *testing.B) {
+				minSize := int64(math.MaxInt64)
+				if async {
+					if runtime.NumCPU() == 1 {
+						b.Skip("NARs are hashed inline with a single CPU")
+					}
+					minSize = 0
+				}
+				setFlag(b, &asyncHashMinSize, minSize)
+
+				c := newTestCache(b)
+				nar := c.add(b, testPath{base: depPath, tree: size.tree}, "zstd", testKey, "", nil)
+				narSize, _ := strconv.ParseInt(nar["NarSize"], 10, 64)
+				d := newTestDownloader(b, c)
+				cl, err := d.discoverDependencies([]string{depPath})
+				if err != nil {
+					b.Fatal(err)
+				}
+				destPath := filepath.Join(d.NixStore, depPath)
+				b.SetBytes(narSize)
+				b.ResetTimer()
+				for range b.N {
+					if err := d.fetchAndManifestStorePath(destPath, cl.StorePaths[0]); err != nil {
+						b.Fatal(err)
+					}
+					b.StopTimer()
+					removeTree(destPath)
+					b.StartTimer()
+				}
+			})
+		}
+	}
+}
+
+func TestDownloadFollowsNarInfoRedirects(t *testing.T) {
+	cdn := newTestCache(t)
+	cdn.add(t, testPath{base: depPath, tree: depTree}, "xz", testKey, "", nil)
+	// The narinfos and NARs are served below /cdn of the other server
+	cdn.setHandle(func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.HasPrefix(r.URL.Path, "/cdn/") {
+			http.NotFound(w, r)
+			return true
+		}
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/cdn")
+		return false
+	})
+	c := newTestCache(t)
+	c.setHandle(func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasSuffix(r.URL.Path, ".narinfo") {
+			http.Redirect(w, r, cdn.URL+"/cdn"+r.URL.Path, http.StatusFound)
+			return true
+		}
+		return false
+	})
+	d := newTestDownloader(t, c)
+
+	cl, err := d.discoverDependencies([]string{depPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp := cl.StorePaths[0]; !strings.HasPrefix(sp.NarURL, cdn.URL+"/cdn/nar/") {
+		t.Errorf("NAR URL %s is not resolved against the redirect target", sp.NarURL)
+	}
+	if _, err := d.fetchAndManifestStorePaths(cl.StorePaths); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, d, depPath, depTree)
+
+	// Redirects to another scheme are refused
+	c.setHandle(func(w http.ResponseWriter, r *http.Request) bool {
+		http.Redirect(w, r, "file:///etc/hostname", http.StatusFound)
+		return true
+	})
+	d = newTestDownloader(t, c)
+	if _, err := d.discoverDependencies([]string{depPath}); err == nil || !strings.Contains(err.Error(), "refusing redirect") {
+		t.Errorf("got error %v, want a refused redirect", err)
+	}
+}
+
+func TestNarInfoParsing(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// edit changes the signed narinfo text
+		edit    func(text []byte, narInfo map[string]string) []byte
+		wantErr string
+	}{
+		{"LF", func(text []byte, _ map[string]string) []byte { return text }, ""},
+		{"CRLF", func(text []byte, _ map[string]string) []byte {
+			return bytes.ReplaceAll(text, []byte("\n"), []byte("\r\n"))
+		}, ""},
+		{"several Sig lines", func(text []byte, narInfo map[string]string) []byte {
+			return appendSig(text, narInfo, otherKey)
+		}, ""},
+		{"duplicate NarSize", func(text []byte, _ map[string]string) []byte {
+			return append(text, "NarSize: 1\n"...)
+		}, "duplicate narinfo field NarSize"},
+		{"duplicate NarHash with the same value", func(text []byte, narInfo map[string]string) []byte {
+			return fmt.Appendf(text, "NarHash: %s\n", narInfo["NarHash"])
+		}, "duplicate narinfo field NarHash"},
+		{"duplicate URL", func(text []byte, _ map[string]string) []byte {
+			return append(text, "URL: nar/other.nar\r\n"...)
+		}, "duplicate narinfo field URL"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCache(t)
+			narInfo := c.add(t, testPath{base: depPath, tree: depTree}, "xz", testKey, "", nil)
+			c.setNarInfo(depPath, tc.edit(narInfoText(narInfo, testKey), narInfo))
+			d := newTestDownloader(t, c)
+
+			cl, err := d.discoverDependencies([]string{depPath})
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %s", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			sp := cl.StorePaths[0]
+			if fmt.Sprint(sp.NarSize) != narInfo["NarSize"] || sp.NarHash != narInfo["NarHash"] {
+				t.Errorf("parsed NarSize %d and NarHash %s, want %s and %s", sp.NarSize, sp.NarHash, narInfo["NarSize"], narInfo["NarHash"])
+			}
+			if _, err := d.fetchAndManifestStorePaths(cl.StorePaths); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestNormalizeSubstituter(t *testing.T) {
+	for _, tc := range []struct {
+		substituter, want, narInfoURL string
+	}{
+		{"https://cache", "https://cache", "https://cache/abc.narinfo"},
+		{"https://cache/", "https://cache", "https://cache/abc.narinfo"},
+		{"https://cache//", "https://cache", "https://cache/abc.narinfo"},
+		{"https://cache/sub/", "https://cache/sub", "https://cache/sub/abc.narinfo"},
+		{"file:///var/cache/", "file:///var/cache", "file:///var/cache/abc.narinfo"},
+	} {
+		got, err := normalizeSubstituter(tc.substituter)
+		if err != nil {
+			t.Errorf("%s: %v", tc.substituter, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s normalized to %s, want %s", tc.substituter, got, tc.want)
+		}
+		if u, err := substituterURL(got, "abc.narinfo"); err != nil || u != tc.narInfoURL {
+			t.Errorf("%s: narinfo URL %s (%v), want %s", tc.substituter, u, err, tc.narInfoURL)
+		}
+	}
+	for _, substituter := range []string{"ftp://cache", "https://", "https://cache?x=1", "cache"} {
+		if got, err := normalizeSubstituter(substituter); err == nil {
+			t.Errorf("%s normalized to %s, want an error", substituter, got)
+		}
+	}
+}
+
+func TestDownloadWithTrailingSlash(t *testing.T) {
+	c := newTestCache(t)
+	c.add(t, testPath{base: depPath, tree: depTree}, "xz", testKey, "", nil)
+	c.setHandle(func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.Contains(r.URL.Path, "//") {
+			t.Errorf("requested %s", r.URL.Path)
+		}
+		return false
+	})
+	d := newTestDownloader(t)
+	substituter, err := normalizeSubstituter(c.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Substituters = []string{substituter}
+	cl, err := d.discoverDependencies([]string{depPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.fetchAndManifestStorePaths(cl.StorePaths); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, d, depPath, depTree)
+}
+
+func TestPrefixedSubstituterURLs(t *testing.T) {
+	const substituter = "https://host/nix-cache"
+	for _, tc := range []struct {
+		ref, want string
+	}{
+		{"nar/abc.nar.xz", "https://host/nix-cache/nar/abc.nar.xz"},
+		{"./nar/abc.nar", "https://host/nix-cache/nar/abc.nar"},
+		{"abc.nar.zst", "https://host/nix-cache/abc.nar.zst"},
+		// Absolute URLs and paths are rejected even within the substituter
+		{"https://host/nix-cache/nar/abc.nar", ""},
+		{"/nix-cache/nar/abc.nar", ""},
+		{"../other/nar/abc.nar", ""},
+	} {
+		got, err := resolveNarURL(substituter, tc.ref)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s resolved to %s, want an error", tc.ref, got)
+			}
+		} else if err != nil || got != tc.want {
+			t.Errorf("%s resolved to %s (%v), want %s", tc.ref, got, err, tc.want)
+		}
+	}
+}
+
+func TestDownloadFromPrefixedSubstituter(t *testing.T) {
+	c := newTestCache(t)
+	c.add(t, testPath{base: topPath, references: []string{depPath}, tree: topTree}, "zstd", testKey, "", nil)
+	c.add(t, testPath{base: depPath, tree: depTree}, "xz", testKey, "", nil)
+	// The cache is served below /nix-cache only
+	c.setHandle(func(w http.ResponseWriter, r *http.Request) bool {
+		path, ok := strings.CutPrefix(r.URL.Path, "/nix-cache/")
+		if !ok {
+			http.NotFound(w, r)
+			return true
+		}
+		r.URL.Path = "/" + path
+		return false
+	})
+	d := newTestDownloader(t)
+	substituter, err := normalizeSubstituter(c.URL + "/nix-cache/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Substituters = []string{substituter}
+
+	cl, err := d.discoverDependencies([]string{topPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.fetchAndManifestStorePaths(cl.StorePaths); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, d, topPath, topTree)
+	checkTree(t, d, depPath, depTree)
+}
+
+func TestDownloadWithOtherStoreDir(t *testing.T) {
+	setFlag(t, &storeDir, "/gnu/store")
+	good := newTestCache(t)
+	good.add(t, testPath{base: topPath, references: []string{depPath}, tree: topTree}, "xz", testKey, "", nil)
+	good.add(t, testPath{base: depPath, tree: depTree}, "zstd", testKey, "", nil)
+	other := newTestCache(t)
+	other.files["/nix-cache-info"] = []byte("StoreDir: /nix/store\n")
+	other.add(t, testPath{base: depPath, tree: depTree}, "zstd", testKey, "", nil)
+
+	d := newTestDownloader(t, other, good)
+	d.probeSubstituters()
+	if len(d.Substituters) != 1 || d.Substituters[0] != good.URL {
+		t.Fatalf("using substituters %v, want only %s", d.Substituters, good.URL)
+	}
+	cl, err := d.discoverDependencies([]string{topPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.fetchAndManifestStorePaths(cl.StorePaths); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, d, topPath, topTree)
+	checkTree(t, d, depPath, depTree)
+
+	// The signature covers the store directory of the references
+	c := newTestCache(t)
+	narInfo := c.add(t, testPath{base: topPath, references: []string{depPath}, tree: topTree}, "zstd", testKey, "", nil)
+	text := narInfoText(narInfo, testKey)
+	text = text[:bytes.Index(text, []byte("Sig: "))]
+	sig := ed25519.Sign(testKey.key, []byte(buildSignatureMessage("/nix/store", narInfo)))
+	text = fmt.Appendf(text, "Sig: %s:%s\n", testKey.name, base64.StdEncoding.EncodeToString(sig))
+	c.setNarInfo(topPath, text)
+	d = newTestDownloader(t, c)
+	if _, err := d.discoverDependencies([]string{topPath}); exitCode(err) != exitVerification {
+		t.Errorf("got error %v for a signature of /nix/store, want a verification error", err)
+	}
+}
+
+func TestStorePathBaseRejectsMalformedNames(t *testing.T) {
+	d := newTestDownloader(t)
+	for _, tc := range []struct {
+		arg, wantErr string
+	}{
+		{depPath, ""},
+		{storeDir + "/" + depPath, ""},
+		{storeDir + "/" + depPath + "/bin/hello", ""},
+		{"abc-hello", "not a store path name"},
+		{"0000000000000000000000000000000-hello", "not a store path name"},
+		{"00000000000000000000000000000000a-hello", "not a store path name"},
+		{"0000000000000000000000000000000e-hello", "invalid hash"},
+		{"0000000000000000000000000000000B-hello", "invalid hash"},
+		{"0000000000000000000000000000000b", "not a store path name"},
+		{"0000000000000000000000000000000b-", "invalid name"},
+		{"0000000000000000000000000000000b-.hidden", "invalid name"},
+		{"0000000000000000000000000000000b-hel lo", "invalid character"},
+		{storeDir + "/abc-hello", "not a store path name"},
+		{storeDir + "/0000000000000000000000000000000e-hello", "invalid hash"},
+		{"/var/empty/" + depPath, "not in " + storeDir},
+	} {
+		base, err := d.storePathBase(tc.arg)
+		if tc.wantErr == "" {
+			if err != nil || base != depPath {
+				t.Errorf("%s: got %s (%v), want %s", tc.arg, base, err, depPath)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got %s (%v), want an error containing %q", tc.arg, base, err, tc.wantErr)
+		}
+	}
+}
+
+func TestStorePathBaseFollowsSymlinks(t *testing.T) {
+	d := newTestDownloader(t)
+	dir := t.TempDir()
+	for link, target := range map[string]string{
+		// The store path does not need to exist for the link to resolve
+		"result":    storeDir + "/" + depPath,
+		"result-2":  "result",
+		"bin":       "result/bin",
+		"local":     d.NixStore + "/" + depPath,
+		"elsewhere": dir,
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	for _, arg := range []string{
+		"result", "./result", dir + "/result", "result/bin/hello",
+		"result-2", "bin", "bin/hello", "local", "local/bin",
+	} {
+		if base, err := d.storePathBase(arg); err != nil || base != depPath {
+			t.Errorf("%s: got %s (%v), want %s", arg, base, err, depPath)
+		}
+	}
+	if base, err := d.storePathBase("elsewhere"); err == nil {
+		t.Errorf("elsewhere: got %s, want an error", base)
+	}
+}
+
+// TestMain runs main instead of the tests in the processes started by
+// runMain.
+func TestMain(m *testing.M) {
+	if args := os.Getenv("NIX_DOWNLOAD_TEST_MAIN"); args != "" {
+		os.Args = append(os.Args[:1], strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the test binary as nix-download with args and returns its exit
+// code.
+func runMain(t *testing.T, args ...string) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "NIX_DOWNLOAD_TEST_MAIN="+strings.Join(args, "\n"))
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return 0
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatal(err)
+	}
+	t.Logf("nix-download %s: %s\n%s", strings.Join(args, " "), err, out)
+	return exitErr.ExitCode()
+}
+
+func TestExitCodes(t *testing.T) {
+	c := newTestCache(t)
+	c.add(t, testPath{base: depPath, tree: depTree}, "xz", testKey, "", nil)
+	c.add(t, testPath{base: topPath, references: []string{depPath}, tree: topTree}, "xz", testKey, nixHash(narOf(t, testPath{base: depPath, tree: depTree})), nil)
+	publicKey := testKey.name + ":" + base64.StdEncoding.EncodeToString(testKey.key.Public().(ed25519.PublicKey))
+	missing := "0000000000000000000000000000000d-missing-1.0"
+
+	for _, tc := range []struct {
+		name  string
+		flags []string
+		paths []string
+		want  int
+	}{
+		{"ok", nil, []string{depPath}, 0},
+		{"bogus path", nil, []string{"bogus"}, exitFailure},
+		{"missing path", nil, []string{missing}, exitFailure},
+		{"missing path with -keep-going", []string{"-keep-going"}, []string{depPath, missing}, exitFailure},
+		{"hash mismatch", nil, []string{topPath}, exitHashMismatch},
+		{"hash mismatch with -keep-going", []string{"-keep-going"}, []string{topPath}, exitHashMismatch},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args := []string{"-quiet", "-store", t.TempDir(), "-substituter", c.URL, "-public-key", publicKey}
+			args = append(append(args, tc.flags...), tc.paths...)
+			if code := runMain(t, args...); code != tc.want {
+				t.Errorf("exited with %d, want %d", code, tc.want)
+			}
+		})
+	}
+}
+
+func TestDownloadWithContentEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		compression string
+		// encode makes the server gzip the NAR file, otherwise the file is
+		// sent as is with the Content-Encoding header
+		encode bool
+	}{
+		{"none", true},
+		{"xz", true},
+		{"zstd", true},
+		{"gzip", false},
+	} {
+		t.Run(tc.compression, func(t *testing.T) {
+			c := newTestCache(t)
+			c.add(t, testPath{base: depPath, tree: depTree}, tc.compression, testKey, "", nil)
+			c.setHandle(func(w http.ResponseWriter, r *http.Request) bool {
+				if !strings.HasPrefix(r.URL.Path, "/nar/") {
+					return false
+				}
+				c.mu.Lock()
+				data := c.files[r.URL.Path]
+				c.mu.Unlock()
+				if tc.encode {
+					data = compressNar(t, data, "gzip")
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(data)
+				return true
+			})
+			d := newTestDownloader(t, c)
+			// The default transport would remove the Content-Encoding itself
+			d.NarClient.Transport = narTransport
+
+			cl, err := d.discoverDependencies([]string{depPath})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := d.fetchAndManifestStorePaths(cl.StorePaths); err != nil {
+				t.Fatal(err)
+			}
+			checkTree(t, d, depPath, depTree)
+		})
+	}
+}
+
+func TestDownloadCopiesAcrossFilesystems(t *testing.T) {
+	c := newTestCache(t)
+	c.add(t, testPath{base: topPath, references: []string{depPath}, tree: topTree}, "zstd", testKey, "", nil)
+	c.add(t, testPath{base: depPath, tree: depTree}, "zstd", testKey, "", nil)
+	d := newTestDownloader(t, c)
+	tempDir := filepath.Join(d.NixStore, tempDirName)
+	var crossed sync.Map
+	setFlag(t, &rename, func(oldPath, newPath string) error {
+		if filepath.Dir(oldPath) == tempDir {
+			crossed.Store(filepath.Base(newPath), true)
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldPath, newPath)
+	})
+
+	cl, err := d.discoverDependencies([]string{topPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.fetchAndManifestStorePaths(cl.StorePaths); err != nil {
+		t.Fatal(err)
+	}
+	for _, base := range []string{topPath, depPath} {
+		if _, ok := crossed.Load(base); !ok {
+			t.Errorf("%s was not renamed across filesystems", base)
+		}
+	}
+	checkTree(t, d, topPath, topTree)
+	checkTree(t, d, depPath, depTree)
+	for name, want := range map[string]os.FileMode{
+		"":              os.ModeDir | 0755,
+		"bin":           os.ModeDir | 0755,
+		"bin/top":       0755,
+		"lib/libtop.so": 0644,
+		"share/doc/dep": os.ModeSymlink | 0777,
+	} {
+		info, err := os.Lstat(filepath.Join(d.NixStore, topPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Errorf("%s has mode %v, want %v", name, info.Mode(), want)
+		}
+	}
+
+	// Neither the copies nor the extracted paths are left behind
+	entries, err := os.ReadDir(d.NixStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); name != topPath && name != depPath && name != tempDirName {
+			t.Errorf("%s was left in the store", name)
+		}
+	}
+	if entries, err := os.ReadDir(tempDir); err != nil || len(entries) != 0 {
+		t.Errorf("%s has %d entries: %v", tempDir, len(entries), err)
+	}
+}
+
+// writeReadOnlyTree writes tree to dir with read-only directories, as Nix
+// leaves the paths it registers.
+func writeReadOnlyTree(t *testing.T, dir string, tree map[string]string) {
+	t.Helper()
+	writeTree(t, dir, tree)
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err == nil && entry.IsDir() {
+			err = os.Chmod(path, 0555)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { removeTree(dir) })
+}
+
+func TestParanoidReplacesCorruptPath(t *testing.T) {
+	c := newTestCache(t)
+	c.add(t, testPath{base: topPath, tree: topTree}, "xz", testKey, "", nil)
+	d := newTestDownloader(t, c)
+	setFlag(t, &paranoid, true)
+	setFlag(t, &corruptPaths, map[string]struct{}{})
+	corrupt := map[string]string{"bin/top*": "corrupt\n", "share/doc/README": "top\n", "extra/file": "extra\n"}
+	writeReadOnlyTree(t, filepath.Join(d.NixStore, topPath), corrupt)
+	// Processes using the old files keep them
+	f, err := os.Open(filepath.Join(d.NixStore, topPath, "bin/top"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cl, err := d.discoverDependencies([]string{topPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.fetchAndManifestStorePaths(cl.StorePaths); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, d, topPath, topTree)
+	if data, err := io.ReadAll(f); err != nil || string(data) != "corrupt\n" {
+		t.Errorf("the open file has %q: %v", data, err)
+	}
+	entries, err := os.ReadDir(d.NixStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); name != topPath && name != tempDirName {
+			t.Errorf("%s was left in the store", name)
+		}
+	}
+}
+
+func TestReplacePathRestoresOldPath(t *testing.T) {
+	dir := t.TempDir()
+	destPath := filepath.Join(dir, topPath)
+	writeReadOnlyTree(t, destPath, depTree)
+	tempDir := filepath.Join(dir, "new")
+	writeTree(t, tempDir, topTree)
+	setFlag(t, &rename, func(oldPath, newPath string) error {
+		if oldPath == tempDir {
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: syscall.EACCES}
+		}
+		return os.Rename(oldPath, newPath)
+	})
+
+	if err := replacePath(tempDir, destPath); err == nil {
+		t.Fatal("replacePath succeeded")
+	}
+	d := &Downloader{NixStore: dir}
+	checkTree(t, d, topPath, depTree)
+	if _, err := os.Lstat(filepath.Join(dir, ".nix-download-old_"+topPath)); !os.IsNotExist(err) {
+		t.Errorf("the old path was left aside: %v", err)
+	}
+}
+
+// countRequests makes c count the requests for each URL path.
+func countRequests(c *testCache) map[string]int {
+	counts := map[string]int{}
+	c.setHandle(func(w http.ResponseWriter, r *http.Request) bool {
+		c.mu.Lock()
+		counts[r.URL.Path]++
+		c.mu.Unlock()
+		return false
+	})
+	return counts
+}
+
+func TestDiscoverSelfReference(t *testing.T) {
+	c := newTestCache(t)
+	c.add(t, testPath{base: topPath, references: []string{topPath}, tree: topTree}, "xz", testKey, "", nil)
+	counts := countRequests(c)
+	d := newTestDownloader(t, c)
+
+	cl, err := d.discoverDependencies([]string{topPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cl.StorePaths) != 1 || cl.StorePaths[0].BasePath != topPath {
+		t.Fatalf("discovered %v, want only %s", cl.StorePaths, topPath)
+	}
+	if _, err := d.fetchAndManifestStorePaths(cl.StorePaths); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, d, topPath, topTree)
+	if n := counts["/0000000000000000000000000000000a.narinfo"]; n != 1 {
+		t.Errorf("the narinfo was requested %d times, want 1", n)
+	}
+}
+
+func TestDiscoverSharedReferenceOnce(t *testing.T) {
+	c := newTestCache(t)
+	// top refers to dep directly and through two paths referring to it
+	c.add(t, testPath{base: topPath, references: []string{testBase(1), testBase(2), depPath}, tree: topTree}, "xz", testKey, "", nil)
+	for i := 1; i <= 2; i++ {
+		c.add(t, testPath{base: testBase(i), references: []string{depPath}, tree: map[string]string{"file": testBase(i)}}, "xz", testKey, "", nil)
+	}
+	narInfo := c.add(t, testPath{base: depPath, tree: depTree}, "xz", testKey, "", nil)
+	counts := countRequests(c)
+	d := newTestDownloader(t, c)
+
+	// dep is also given as a root
+	cl, err := d.discoverDependencies([]string{topPath, depPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cl.StorePaths) != 4 {
+		t.Fatalf("discovered %d paths, want 4", len(cl.StorePaths))
+	}
+	if _, err := d.fetchAndManifestStorePaths(cl.StorePaths); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, d, depPath, depTree)
+	if n := counts["/0000000000000000000000000000000b.narinfo"]; n != 1 {
+		t.Errorf("the narinfo of %s was requested %d times, want 1", depPath, n)
+	}
+	if n := counts["/"+narInfo["URL"]]; n != 1 {
+		t.Errorf("the NAR of %s was requested %d times, want 1", depPath, n)
+	}
+}
+
+func TestNarInfoRoundTrip(t *testing.T) {
+	c := newTestCache(t)
+	narInfo := c.add(t, testPath{base: topPath, references: []string{depPath, topPath}, tree: topTree}, "xz", testKey, "", nil)
+	// The references are not sorted, the fields after them are not signed
+	narInfo["References"] = depPath + " " + topPath
+	text := narInfoText(narInfo, testKey)
+	text = append(text, "Deriver: 0000000000000000000000000000000d-top-1.0.drv\nCA: \nX-Extra: a: b\n"...)
+	c.setNarInfo(topPath, appendSig(text, narInfo, otherKey))
+
+	parse := func() StorePath {
+		t.Helper()
+		sp, err := newTestDownloader(t, c).fetchNarInfo(topPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sp
+	}
+	sp := parse()
+	formatted := formatNarInfo(sp, sp.NarInfo["URL"], sp.NarInfo["FileHash"], sp.FileSize)
+	if !bytes.Contains(formatted, []byte("References: "+depPath+" "+topPath+"\n")) {
+		t.Errorf("the references were reordered:\n%s", formatted)
+	}
+	c.setNarInfo(topPath, formatted)
+	reparsed := parse()
+
+	if fmt.Sprint(reparsed.NarInfo) != fmt.Sprint(sp.NarInfo) {
+		t.Errorf("got fields %v, want %v", reparsed.NarInfo, sp.NarInfo)
+	}
+	if fmt.Sprint(reparsed.Sigs) != fmt.Sprint(sp.Sigs) || len(sp.Sigs) != 2 {
+		t.Errorf("got signatures %v, want %v", reparsed.Sigs, sp.Sigs)
+	}
+	if fmt.Sprint(reparsed.References) != fmt.Sprint(sp.References) {
+		t.Errorf("got references %v, want %v", reparsed.References, sp.References)
+	}
+	if again := formatNarInfo(reparsed, reparsed.NarInfo["URL"], reparsed.NarInfo["FileHash"], reparsed.FileSize); !bytes.Equal(again, formatted) {
+		t.Errorf("formatting again gave\n%s\nwant\n%s", again, formatted)
+	}
+}
+
+func TestDiscoverWithRefFilters(t *testing.T) {
+	c := newTestCache(t)
+	c.add(t, testPath{base: topPath, references: []string{depPath, testBase(1), testBase(2)}, tree: topTree}, "xz", testKey, "", nil)
+	c.add(t, testPath{base: depPath, references: []string{testBase(3)}, tree: depTree}, "xz", testKey, "", nil)
+	for i := 1; i <= 3; i++ {
+		c.add(t, testPath{base: testBase(i), tree: map[string]string{"file": testBase(i)}}, "xz", testKey, "", nil)
+	}
+
+	for _, tc := range []struct {
+		filters []string
+		want    []string
+	}{
+		{nil, []string{topPath, depPath, testBase(1), testBase(2), testBase(3)}},
+		// path-3 is only referenced by dep
+		{[]string{"!dep-*"}, []string{topPath, testBase(1), testBase(2)}},
+		{[]string{"path-*"}, []string{topPath, testBase(1), testBase(2)}},
+		{[]string{"path-*", "dep-*"}, []string{topPath, depPath, testBase(1), testBase(2), testBase(3)}},
+		{[]string{"path-*", "!path-2"}, []string{topPath, testBase(1)}},
+		// The root is always downloaded
+		{[]string{"!top-*"}, []string{topPath, depPath, testBase(1), testBase(2), testBase(3)}},
+		{[]string{"none"}, []string{topPath}},
+	} {
+		var filters []refFilter
+		for _, s := range tc.filters {
+			f, err := parseRefFilter(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filters = append(filters, f)
+		}
+		setFlag(t, &refFilters, filters)
+		cl, err := newTestDownloader(t, c).discoverDependencies([]string{topPath})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, sp := range cl.StorePaths {
+			got = append(got, sp.BasePath)
+		}
+		slices.Sort(got)
+		slices.Sort(tc.want)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("-ref-filter %v: discovered %v, want %v", tc.filters, got, tc.want)
+		}
+	}
+
+	for _, s := range []string{"", "!", "[", "!path-[2"} {
+		if _, err := parseRefFilter(s); err == nil {
+			t.Errorf("parseRefFilter(%q) succeeded", s)
+		}
+	}
+}
+
+func TestSignAndVerifyNarInfo(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	seed := bytes.Repeat([]byte{3}, ed25519.SeedSize)
+	secret := "signer-1:" + base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(seed)) + "\n"
+	if err := os.WriteFile(keyFile, []byte(secret), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sk, err := loadSecretKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDownloader(t)
+	d.KnownKeys = map[string]ed25519.PublicKey{sk.name: sk.key.Public().(ed25519.PublicKey)}
+
+	c := newTestCache(t)
+	narInfo := c.add(t, testPath{base: topPath, references: []string{depPath, topPath}, tree: topTree}, "xz", testKey, "", nil)
+	sig := signNarInfo(narInfo, sk)
+	if err := d.verifyNarInfoSignature(narInfo, []string{sig}); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{
+		"StorePath":  storeDir + "/" + depPath,
+		"NarHash":    nixHash(nil),
+		"NarSize":    "1",
+		"References": depPath,
+	} {
+		changed := maps.Clone(narInfo)
+		changed[key] = value
+		if err := d.verifyNarInfoSignature(changed, []string{sig}); err == nil {
+			t.Errorf("the signature is valid with another %s", key)
+		}
+	}
+	// The file fields are not signed
+	changed := maps.Clone(narInfo)
+	changed["URL"], changed["Compression"] = "nar/other.nar", "none"
+	if err := d.verifyNarInfoSignature(changed, []string{sig}); err != nil {
+		t.Errorf("the signature is invalid with another URL: %v", err)
+	}
+	if err := d.verifyNarInfoSignature(narInfo, []string{signNarInfo(narInfo, testKey)}); err == nil {
+		t.Error("the signature of an unknown key is valid")
+	}
+
+	// Narinfos written with -secret-key-file verify with its public key only
+	setFlag(t, &signingKey, &sk)
+	sp, err := newTestDownloader(t, c).fetchNarInfo(topPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.setNarInfo(topPath, formatNarInfo(sp, sp.NarInfo["URL"], sp.NarInfo["FileHash"], sp.FileSize))
+	d.Substituters = []string{c.URL}
+	if _, err := d.fetchNarInfo(topPath); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, invalid := range []string{"", "signer-1", ":" + base64.StdEncoding.EncodeToString(sk.key), "signer-1:%%", "signer-1:" + base64.StdEncoding.EncodeToString(seed)} {
+		if err := os.WriteFile(keyFile, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadSecretKey(keyFile); err == nil {
+			t.Errorf("loaded the invalid secret key %q", invalid)
+		}
+	}
+}
+
+func TestDownloadWritesListings(t *testing.T) {
+	c := newTestCache(t)
+	c.add(t, testPath{base: topPath, tree: topTree}, "zstd", testKey, "", nil)
+	d := newTestDownloader(t, c)
+	setFlag(t, &listingDir, t.TempDir())
+
+	cl, err := d.discoverDependencies([]string{topPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.fetchAndManifestStorePaths(cl.StorePaths); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(listingDir, "0000000000000000000000000000000a.ls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listing narextract.Listing
+	if err := json.Unmarshal(data, &listing); err != nil {
+		t.Fatalf("the listing is not plain JSON: %v", err)
+	}
+	if listing.Version != 1 || listing.Root == nil || listing.Root.Type != "directory" {
+		t.Fatalf("got listing %s", data)
+	}
+
+	// The offsets point to the contents of the files in the NAR
+	nar := narOf(t, testPath{base: topPath, tree: topTree})
+	for name, want := range map[string]string{"bin/top": topTree["bin/top*"], "lib/libtop.so": topTree["lib/libtop.so"]} {
+		entry := listing.Root
+		for _, component := range strings.Split(name, "/") {
+			entry = entry.Entries[component]
+			if entry == nil {
+				t.Fatalf("%s is missing from the listing %s", name, data)
+			}
+		}
+		if entry.Type != "regular" || entry.Size != int64(len(want)) || entry.Executable != (name == "bin/top") {
+			t.Errorf("%s has entry %+v", name, entry)
+		} else if got := string(nar[entry.NarOffset : entry.NarOffset+entry.Size]); got != want {
+			t.Errorf("%s at offset %d has %q, want %q", name, entry.NarOffset, got, want)
+		}
+	}
+	if link := listing.Root.Entries["share"].Entries["doc"].Entries["dep"]; link == nil || link.Type != "symlink" || link.Target != "../../lib/libtop.so" {
+		t.Errorf("share/doc/dep has entry %+v", link)
+	}
+}
+
+func TestParallelRoots(t *testing.T) {
+	c := newTestCache(t)
+	const roots = 6
+	depInfo := c.add(t, testPath{base: depPath, tree: depTree}, "xz", testKey, "", nil)
+	var args []string
+	for i := range roots {
+		c.add(t, testPath{base: testBase(i), references: []string{depPath}, tree: map[string]string{"file": testBase(i)}}, "xz", testKey, "", nil)
+		args = append(args, testBase(i))
+	}
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	requests := map[string]int{}
+	c.setHandle(func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.HasPrefix(r.URL.Path, "/nar/") {
+			return false
+		}
+		mu.Lock()
+		requests[r.URL.Path]++
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+		// Keep the downloads of the roots overlapping
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return false
+	})
+	publicKey := testKey.name + ":" + base64.StdEncoding.EncodeToString(testKey.key.Public().(ed25519.PublicKey))
+	store := t.TempDir()
+
+	args = append([]string{"-quiet", "-store", store, "-substituter", c.URL, "-public-key", publicKey, "-parallel-roots", "4", "-jobs", "2"}, args...)
+	if code := runMain(t, args...); code != 0 {
+		t.Fatalf("exited with %d", code)
+	}
+	d := &Downloader{NixStore: store}
+	checkTree(t, d, depPath, depTree)
+	for i := range roots {
+		checkTree(t, d, testBase(i), map[string]string{"file": testBase(i)})
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if n := requests["/"+depInfo["URL"]]; n != 1 {
+		t.Errorf("the NAR of %s was requested %d times, want 1", depPath, n)
+	}
+	if maxRunning > 2 {
+		t.Errorf("%d NARs were downloaded at the same time, want at most 2", maxRunning)
+	}
+
+	for _, invalid := range []string{"-1", "2 -export", "2 -use-daemon"} {
+		args := append([]string{"-store", t.TempDir(), "-substituter", c.URL, "-parallel-roots"}, strings.Fields(invalid)...)
+		if code := runMain(t, append(args, depPath)...); code != exitFailure {
+			t.Errorf("-parallel-roots %s: exited with %d, want %d", invalid, code, exitFailure)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// narMemory bounds the total NarSize of the paths decompressed at the same
+// time to -max-memory, so that several large NARs do not exhaust the memory
+// while many small ones still run concurrently.
+var narMemory memoryBudget
+
+// memoryBudget is a weighted semaphore granting memory in the order it is
+// requested, so that a large request is not starved by small ones.
+type memoryBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+	// waiters are the requests not granted yet, in order
+	waiters []*memoryWaiter
+}
+
+type memoryWaiter struct {
+	size  int64
+	ready chan struct{}
+}
+
+// acquire waits until size bytes are available and returns the function
+// releasing them. Requests larger than the limit are granted alone.
+func (b *memoryBudget) acquire(ctx context.Context, size int64) (func(), error) {
+	if b.limit <= 0 {
+		return func() {}, nil
+	}
+	size = min(size, b.limit)
+	release := func() {
+		b.mu.Lock()
+		b.used -= size
+		b.grant()
+		b.mu.Unlock()
+	}
+
+	b.mu.Lock()
+	if len(b.waiters) == 0 && b.used+size <= b.limit {
+		b.used += size
+		b.mu.Unlock()
+		return release, nil
+	}
+	w := &memoryWaiter{size: size, ready: make(chan struct{})}
+	b.waiters = append(b.waiters, w)
+	b.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-w.ready:
+		// Granted while giving up
+		b.used -= size
+	default:
+		for i, other := range b.waiters {
+			if other == w {
+				b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+	b.grant()
+	return nil, ctx.Err()
+}
+
+// grant grants the waiting requests that fit, in order. b.mu must be held.
+func (b *memoryBudget) grant() {
+	for len(b.waiters) > 0 && b.used+b.waiters[0].size <= b.limit {
+		w := b.waiters[0]
+		b.waiters = b.waiters[1:]
+		b.used += w.size
+		close(w.ready)
+	}
+}
+
+// acquireNarMemory waits until the NAR of sp may be decompressed and returns
+// the function to call once it is done.
+func acquireNarMemory(sp StorePath) (func(), error) {
+	release, err := narMemory.acquire(runCtx, sp.NarSize)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for memory: %w", err)
+	}
+	return release, nil
+}
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix for
+// KiB, MiB, GiB and TiB.
+func parseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	shift := 0
+	if num != "" {
+		if i := strings.IndexByte("KMGT", num[len(num)-1]); i >= 0 {
+			shift = 10 * (i + 1)
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// runStart is when nix-download started, the -metrics-file duration is
+// measured from it.
+var runStart = time.Now()
+
+// narBytes counts the bytes of NARs received from the substituters.
+var narBytes atomic.Int64
+
+var (
+	substituterHitsMu sync.Mutex
+	// substituterHits counts the narinfos served by each substituter
+	substituterHits = map[string]int64{}
+)
+
+// recordSubstituterHit counts a narinfo served by substituter.
+func recordSubstituterHit(substituter string) {
+	substituterHitsMu.Lock()
+	substituterHits[substituter]++
+	substituterHitsMu.Unlock()
+}
+
+// meteredReader adds the bytes read from r to narBytes.
+type meteredReader struct {
+	r io.Reader
+}
+
+func (mr meteredReader) Read(p []byte) (int, error) {
+	n, err := mr.r.Read(p)
+	narBytes.Add(int64(n))
+	return n, err
+}
+
+// runMetrics are the results of a run written by -metrics-file.
+type runMetrics struct {
+	// Downloaded is the number of paths downloaded
+	Downloaded int
+	// Failed is the number of paths that were not downloaded because they
+	// failed, were skipped or the run was cancelled
+	Failed int
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes m and the global counters to file in the Prometheus
+// text exposition format. The file is replaced atomically, so that the
+// node_exporter textfile collector never reads a partial file.
+func writeMetrics(file string, m runMetrics) error {
+	var buf bytes.Buffer
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	metric("nix_download_paths_total", "counter", "Store paths downloaded.")
+	fmt.Fprintf(&buf, "nix_download_paths_total %d\n", m.Downloaded)
+	metric("nix_download_bytes_total", "counter", "Bytes of NARs received from the substituters.")
+	fmt.Fprintf(&buf, "nix_download_bytes_total %d\n", narBytes.Load())
+	metric("nix_download_failures_total", "counter", "Store paths that failed, were skipped or were not downloaded before the run was cancelled.")
+	fmt.Fprintf(&buf, "nix_download_failures_total %d\n", m.Failed)
+	metric("nix_download_duration_seconds", "gauge", "Duration of the run.")
+	fmt.Fprintf(&buf, "nix_download_duration_seconds %g\n", time.Since(runStart).Seconds())
+
+	metric("nix_download_substituter_hits_total", "counter", "Narinfos served by each substituter.")
+	substituterHitsMu.Lock()
+	substituters := make([]string, 0, len(substituterHits))
+	for substituter := range substituterHits {
+		substituters = append(substituters, substituter)
+	}
+	slices.Sort(substituters)
+	for _, substituter := range substituters {
+		fmt.Fprintf(&buf, "nix_download_substituter_hits_total{substituter=\"%s\"} %d\n", labelValueEscaper.Replace(substituter), substituterHits[substituter])
+	}
+	substituterHitsMu.Unlock()
+
+	return writeFileAtomic(file, buf.Bytes())
+}
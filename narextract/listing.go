@@ -0,0 +1,70 @@
+package narextract
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Listing is the top-level structure of a Nix binary cache .ls file.
+type Listing struct {
+	Version int    `json:"version"`
+	Root    *Entry `json:"root"`
+}
+
+// NewListing wraps root in a version 1 listing.
+func NewListing(root *Entry) *Listing {
+	return &Listing{Version: 1, Root: root}
+}
+
+// Entry describes an object in a NAR. NarOffset is the offset of the file
+// contents within the NAR stream and is only meaningful for regular files.
+type Entry struct {
+	Type       string            `json:"type"`
+	Size       int64             `json:"size"`
+	Executable bool              `json:"executable"`
+	NarOffset  int64             `json:"narOffset"`
+	Target     string            `json:"target"`
+	Entries    map[string]*Entry `json:"entries"`
+}
+
+func (e Entry) MarshalJSON() ([]byte, error) {
+	switch e.Type {
+	case "regular":
+		return json.Marshal(struct {
+			Type       string `json:"type"`
+			Size       int64  `json:"size"`
+			Executable bool   `json:"executable,omitempty"`
+			NarOffset  int64  `json:"narOffset"`
+		}{e.Type, e.Size, e.Executable, e.NarOffset})
+	case "symlink":
+		return json.Marshal(struct {
+			Type   string `json:"type"`
+			Target string `json:"target"`
+		}{e.Type, e.Target})
+	case "directory":
+		entries := e.Entries
+		if entries == nil {
+			entries = map[string]*Entry{}
+		}
+		return json.Marshal(struct {
+			Type    string            `json:"type"`
+			Entries map[string]*Entry `json:"entries"`
+		}{e.Type, entries})
+	default:
+		return json.Marshal(struct {
+			Type string `json:"type"`
+		}{e.Type})
+	}
+}
+
+// countingReader keeps track of the number of bytes read from the NAR stream.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
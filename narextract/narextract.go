@@ -3,6 +3,7 @@ package narextract
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -11,13 +12,31 @@ import (
 )
 
 type NarExtractor struct {
-	reader io.Reader
-	topDir string
+	reader   *countingReader
+	topDir   string
+	root     Entry
+	listOnly bool
+	maxSize  int64
+	// intoExisting extracts the top-level directory into the existing
+	// topDir
+	intoExisting bool
+	// contents receives the contents of the single regular file of a NAR
+	// read by ExtractSingleFile
+	contents io.Writer
+	// symlinkFallbacks are the symlinks written as files containing their
+	// target
+	symlinkFallbacks []string
 
 	nextString string
+	nextOffset int64
 	haveNext   bool
+	lastOffset int64
 }
 
+// ErrNarTooLarge is returned if the contents of a file would extend the NAR
+// past the size set with SetMaxSize.
+var ErrNarTooLarge = errors.New("NAR exceeds declared size")
+
 // Should be more then enough
 const maxStringLength = 16 * 1024
 
@@ -26,7 +45,68 @@ func NewNarExtractor(reader io.Reader, topDir string) (*NarExtractor, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get absolute path: %w", err)
 	}
-	return &NarExtractor{reader: reader, topDir: absPath}, nil
+	return &NarExtractor{reader: &countingReader{r: reader}, topDir: absPath}, nil
+}
+
+// List parses the NAR read from reader and returns its listing without
+// writing anything to disk.
+func List(reader io.Reader) (*Entry, error) {
+	ne := &NarExtractor{reader: &countingReader{r: reader}, listOnly: true}
+	if err := ne.Extract(); err != nil {
+		return nil, err
+	}
+	return ne.Listing(), nil
+}
+
+// ExtractSingleFile copies the contents of the NAR read from reader, which
+// must consist of a single regular file, to w without writing anything to
+// disk and returns the mode of the file, 0644 or 0755. NARs of a directory or
+// symlink fail before anything is written to w.
+func ExtractSingleFile(reader io.Reader, w io.Writer) (os.FileMode, error) {
+	ne := &NarExtractor{reader: &countingReader{r: reader}, listOnly: true, contents: w}
+	if err := ne.Extract(); err != nil {
+		return 0, err
+	}
+	if ne.root.Executable {
+		return 0755, nil
+	}
+	return 0644, nil
+}
+
+// SetMaxSize makes extraction fail with ErrNarTooLarge before writing a file
+// whose contents would extend the NAR past size bytes, e.g. the NarSize of
+// its narinfo.
+func (ne *NarExtractor) SetMaxSize(size int64) {
+	ne.maxSize = size
+}
+
+// SetIntoExisting makes Extract write the contents of the top-level directory
+// of the NAR into topDir, which must be an existing empty directory, instead
+// of creating topDir. NARs of a single file or symlink cannot be extracted
+// that way.
+func (ne *NarExtractor) SetIntoExisting(into bool) {
+	ne.intoExisting = into
+}
+
+// SymlinkFallbacks returns the paths of the symlinks that could not be
+// created and were written as files containing their target instead, which
+// only happens on Windows.
+func (ne *NarExtractor) SymlinkFallbacks() []string {
+	return ne.symlinkFallbacks
+}
+
+// Offset returns the current position in the NAR stream. A string pushed back
+// by the directory entry lookahead counts as not yet consumed.
+func (ne *NarExtractor) Offset() int64 {
+	if ne.haveNext {
+		return ne.nextOffset
+	}
+	return ne.reader.n
+}
+
+// Listing returns the tree of objects extracted by Extract.
+func (ne *NarExtractor) Listing() *Entry {
+	return &ne.root
 }
 
 func (ne *NarExtractor) Extract() error {
@@ -38,13 +118,25 @@ func (ne *NarExtractor) Extract() error {
 		return fmt.Errorf("invalid NAR magic: %s", magic)
 	}
 
-	if parent := filepath.Dir(ne.topDir); parent != ne.topDir {
+	if ne.listOnly {
+		return ne.extractNarObj(".", &ne.root)
+	}
+
+	if ne.intoExisting {
+		entries, err := os.ReadDir(ne.topDir)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 0 {
+			return fmt.Errorf("%s is not empty", ne.topDir)
+		}
+	} else if parent := filepath.Dir(ne.topDir); parent != ne.topDir {
 		_ = os.MkdirAll(parent, 0755)
 	}
-	return ne.extractNarObj(".")
+	return ne.extractNarObj(".", &ne.root)
 }
 
-func (ne *NarExtractor) extractNarObj(path string) error {
+func (ne *NarExtractor) extractNarObj(path string, entry *Entry) error {
 	if err := ne.expectString("("); err != nil {
 		return err
 	}
@@ -57,15 +149,22 @@ func (ne *NarExtractor) extractNarObj(path string) error {
 	if err != nil {
 		return err
 	}
+	if ne.intoExisting && path == "." && objType != "directory" {
+		return fmt.Errorf("cannot extract a NAR of type %s into an existing directory", objType)
+	}
+	if ne.contents != nil && path == "." && objType != "regular" {
+		return fmt.Errorf("NAR is of type %s, not a single regular file", objType)
+	}
 
+	entry.Type = objType
 	var extractErr error
 	switch objType {
 	case "regular":
-		extractErr = ne.extractRegular(path)
+		extractErr = ne.extractRegular(path, entry)
 	case "symlink":
-		extractErr = ne.extractSymlink(path)
+		extractErr = ne.extractSymlink(path, entry)
 	case "directory":
-		extractErr = ne.extractDirectory(path)
+		extractErr = ne.extractDirectory(path, entry)
 	default:
 		extractErr = fmt.Errorf("unknown object type: %s", objType)
 	}
@@ -77,7 +176,7 @@ func (ne *NarExtractor) extractNarObj(path string) error {
 	return ne.expectString(")")
 }
 
-func (ne *NarExtractor) extractRegular(path string) error {
+func (ne *NarExtractor) extractRegular(path string, entry *Entry) error {
 	nextField, err := ne.readString()
 	if err != nil {
 		return err
@@ -101,12 +200,27 @@ func (ne *NarExtractor) extractRegular(path string) error {
 
 	fullPath := filepath.Join(ne.topDir, path)
 
-	length, err := ne.readInt64()
+	length, err := ne.readLength()
 	if err != nil {
 		return fmt.Errorf("failed to read file length: %s: %w", fullPath, err)
 	}
+	if ne.maxSize > 0 && length > ne.maxSize-ne.Offset() {
+		return fmt.Errorf("%w: %s has %d bytes at offset %d of %d", ErrNarTooLarge, fullPath, length, ne.Offset(), ne.maxSize)
+	}
 
-	if err := ne.writeFile(fullPath, length, mode); err != nil {
+	entry.Size = length
+	entry.Executable = mode == 0755
+	entry.NarOffset = ne.Offset()
+
+	if ne.listOnly {
+		w := io.Discard
+		if ne.contents != nil {
+			w = ne.contents
+		}
+		if _, err := io.CopyN(w, ne.reader, length); err != nil {
+			return fmt.Errorf("failed to read file contents %s: %w", fullPath, err)
+		}
+	} else if err := ne.writeFile(fullPath, length, mode); err != nil {
 		return fmt.Errorf("failed to write file %s: %w", fullPath, err)
 	}
 
@@ -120,7 +234,7 @@ func (ne *NarExtractor) extractRegular(path string) error {
 	return nil
 }
 
-func (ne *NarExtractor) extractSymlink(path string) error {
+func (ne *NarExtractor) extractSymlink(path string, entry *Entry) error {
 	if err := ne.expectString("target"); err != nil {
 		return err
 	}
@@ -130,19 +244,36 @@ func (ne *NarExtractor) extractSymlink(path string) error {
 		return err
 	}
 
+	entry.Target = target
+	if ne.listOnly {
+		return nil
+	}
+
 	fullPath := filepath.Join(ne.topDir, path)
-	if err := os.Symlink(target, fullPath); err != nil {
+	fallback, err := createSymlink(target, fullPath)
+	if err != nil {
 		return fmt.Errorf("failed to create symlink %s -> %s: %w", fullPath, target, err)
 	}
+	if fallback {
+		ne.symlinkFallbacks = append(ne.symlinkFallbacks, fullPath)
+	}
 
 	return nil
 }
 
-func (ne *NarExtractor) extractDirectory(path string) error {
-	fullPath := filepath.Join(ne.topDir, path)
-	if err := os.Mkdir(fullPath, 0755); err != nil {
-		return fmt.Errorf("failed to create directory %s: %w", fullPath, err)
+func (ne *NarExtractor) extractDirectory(path string, dir *Entry) error {
+	// The existing top directory keeps its mode
+	if !ne.listOnly && !(ne.intoExisting && path == ".") {
+		fullPath := filepath.Join(ne.topDir, path)
+		if err := os.Mkdir(fullPath, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", fullPath, err)
+		}
+		// Mkdir applies the umask, store directories are always 0755
+		if err := os.Chmod(fullPath, 0755); err != nil {
+			return fmt.Errorf("failed to set mode of directory %s: %w", fullPath, err)
+		}
 	}
+	dir.Entries = make(map[string]*Entry)
 
 	prev := ""
 	for {
@@ -182,9 +313,11 @@ func (ne *NarExtractor) extractDirectory(path string) error {
 			return err
 		}
 
-		if err := ne.extractNarObj(filepath.Join(path, name)); err != nil {
+		child := &Entry{}
+		if err := ne.extractNarObj(filepath.Join(path, name), child); err != nil {
 			return err
 		}
+		dir.Entries[name] = child
 
 		if err := ne.expectString(")"); err != nil {
 			return err
@@ -197,26 +330,31 @@ func (ne *NarExtractor) extractDirectory(path string) error {
 }
 
 func (ne *NarExtractor) unread(str string) {
-	ne.nextString, ne.haveNext = str, true
+	ne.nextString, ne.nextOffset, ne.haveNext = str, ne.lastOffset, true
 }
 
 func (ne *NarExtractor) readString() (str string, err error) {
 	if ne.haveNext {
 		str = ne.nextString
+		ne.lastOffset = ne.nextOffset
 		ne.nextString, ne.haveNext = "", false
 		return str, nil
 	}
-	length, err := ne.readInt64()
+	ne.lastOffset = ne.reader.n
+	length, err := ne.readLength()
 	if err != nil {
 		return "", err
 	}
 
+	// Checking the length before converting it to int also keeps 32-bit
+	// platforms safe
 	if length > maxStringLength {
 		return "", fmt.Errorf("string length exceeds maximum of %d, got: %d", maxStringLength, length)
 	}
 
-	padding := int((8 - (length % 8)) % 8)
-	data := make([]byte, length+int64(padding))
+	n := int(length)
+	padding := (8 - n%8) % 8
+	data := make([]byte, n+padding)
 	if _, err := io.ReadFull(ne.reader, data); err != nil {
 		return "", fmt.Errorf("failed to read string data: %w", err)
 	}
@@ -236,6 +374,20 @@ func (ne *NarExtractor) readInt64() (int64, error) {
 	return value, nil
 }
 
+// readLength reads the length of a string or of file contents. NARs encode
+// lengths as unsigned 64-bit integers, those not fitting an int64 are
+// rejected instead of being returned as negative lengths.
+func (ne *NarExtractor) readLength() (int64, error) {
+	length, err := ne.readInt64()
+	if err != nil {
+		return 0, err
+	}
+	if length < 0 {
+		return 0, fmt.Errorf("invalid length %d", uint64(length))
+	}
+	return length, nil
+}
+
 func (ne *NarExtractor) expectString(expected string) error {
 	s, err := ne.readString()
 	if err != nil {
@@ -247,19 +399,33 @@ func (ne *NarExtractor) expectString(expected string) error {
 	return nil
 }
 
+// writeFile creates path with exactly the mode perm, which is 0644 or 0755.
+// NARs cannot encode setuid, setgid or sticky bits, and the explicit Chmod
+// makes the mode independent of the umask OpenFile applies.
 func (ne *NarExtractor) writeFile(path string, n int64, perm os.FileMode) error {
 	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
 	if err != nil {
 		return err
 	}
 	defer fd.Close()
+	if err := fd.Chmod(perm); err != nil {
+		return err
+	}
 	_, err = io.CopyN(fd, ne.reader, n)
 	return err
 }
 
+// ValidEntryName reports whether name may be the name of a directory entry,
+// i.e. a single path component. Extract rejects NARs with other names, code
+// joining the names of a listing with a path has to check them the same way.
+func ValidEntryName(name string) bool {
+	return isValidPathComponent(name)
+}
+
 func isValidPathComponent(name string) bool {
 	return name != "" &&
 		name != "." &&
 		name != ".." &&
-		!strings.Contains(name, "/")
+		!strings.ContainsAny(name, "/\x00") &&
+		isValidPlatformName(name)
 }
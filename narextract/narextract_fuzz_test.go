@@ -0,0 +1,104 @@
+package narextract_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/simonfxr/nix-download/narextract"
+)
+
+// narString encodes s as a NAR string: its length followed by the padded
+// bytes.
+func narString(s string) []byte {
+	b := binary.LittleEndian.AppendUint64(nil, uint64(len(s)))
+	b = append(b, s...)
+	for len(b)%8 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func narTokens(tokens ...string) []byte {
+	var b []byte
+	for _, t := range tokens {
+		b = append(b, narString(t)...)
+	}
+	return b
+}
+
+// narRegular, narSymlink and narDirectory encode NAR objects, entries maps
+// the sorted names of a directory to their objects.
+func narRegular(contents string, executable bool) []byte {
+	b := narTokens("(", "type", "regular")
+	if executable {
+		b = append(b, narTokens("executable", "")...)
+	}
+	return append(b, narTokens("contents", contents, ")")...)
+}
+
+func narSymlink(target string) []byte {
+	return narTokens("(", "type", "symlink", "target", target, ")")
+}
+
+func narDirectory(names []string, objects ...[]byte) []byte {
+	b := narTokens("(", "type", "directory")
+	for i, name := range names {
+		b = append(b, narTokens("entry", "(", "name", name, "node")...)
+		b = append(b, objects[i]...)
+		b = append(b, narTokens(")")...)
+	}
+	return append(b, narTokens(")")...)
+}
+
+func nar(object []byte) []byte {
+	return append(narTokens("nix-archive-1"), object...)
+}
+
+// FuzzExtract feeds arbitrary NARs to the extractor, which must reject them
+// with an error rather than panic or write outside of its directory, and
+// must reject what List rejects.
+func FuzzExtract(f *testing.F) {
+	f.Add(nar(narRegular("hello\n", false)))
+	f.Add(nar(narRegular("", true)))
+	f.Add(nar(narSymlink("../target")))
+	f.Add(nar(narDirectory(nil)))
+	f.Add(nar(narDirectory(
+		[]string{"bin", "lib", "share"},
+		narDirectory([]string{"hello"}, narRegular("#!/bin/sh\n", true)),
+		narSymlink("share"),
+		narDirectory([]string{"a", "b"}, narRegular("a", false), narRegular("b", false)),
+	)))
+	// Invalid names and order
+	f.Add(nar(narDirectory([]string{".."}, narRegular("x", false))))
+	f.Add(nar(narDirectory([]string{"b", "a"}, narRegular("", false), narRegular("", false))))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parent := t.TempDir()
+		topDir := filepath.Join(parent, "out")
+		ne, err := narextract.NewNarExtractor(bytes.NewReader(data), topDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ne.SetMaxSize(int64(len(data)))
+		extractErr := ne.Extract()
+
+		entries, err := os.ReadDir(parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if entry.Name() != "out" {
+				t.Fatalf("extraction created %s outside of its directory", entry.Name())
+			}
+		}
+
+		// Extract can additionally fail on the filesystem
+		_, listErr := narextract.List(bytes.NewReader(data))
+		if listErr != nil && extractErr == nil {
+			t.Fatalf("Extract accepted a NAR that List rejects: %v", listErr)
+		}
+	})
+}
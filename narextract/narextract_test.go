@@ -0,0 +1,153 @@
+package narextract_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/simonfxr/nix-download/narextract"
+)
+
+// narLength encodes n as a raw NAR length, which need not be valid.
+func narLength(n uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, n)
+}
+
+// extract extracts nar into a new directory and returns the directory and
+// the error of Extract.
+func extract(t *testing.T, nar []byte) (string, error) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "out")
+	ne, err := narextract.NewNarExtractor(bytes.NewReader(nar), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, ne.Extract()
+}
+
+func TestExtractRejectsNegativeLengths(t *testing.T) {
+	for _, length := range []uint64{1 << 63, 1<<63 + 8, math.MaxUint64} {
+		for name, nar := range map[string][]byte{
+			"string":   append(narTokens("nix-archive-1"), narLength(length)...),
+			"contents": append(narTokens("nix-archive-1", "(", "type", "regular", "contents"), narLength(length)...),
+		} {
+			_, err := extract(t, nar)
+			if err == nil || !strings.Contains(err.Error(), "invalid length") {
+				t.Errorf("%s length %d: got error %v, want an invalid length", name, length, err)
+			}
+			if _, err := narextract.List(bytes.NewReader(nar)); err == nil {
+				t.Errorf("%s length %d: List accepted the NAR", name, length)
+			}
+		}
+	}
+}
+
+func TestExtractRejectsLengthsNearMaxInt32(t *testing.T) {
+	for _, length := range []uint64{math.MaxInt32 - 7, math.MaxInt32, math.MaxInt32 + 1, math.MaxUint32} {
+		nar := append(narTokens("nix-archive-1", "(", "type"), narLength(length)...)
+		_, err := extract(t, nar)
+		if err == nil || !strings.Contains(err.Error(), "string length exceeds maximum") {
+			t.Errorf("string length %d: got error %v, want the maximum string length exceeded", length, err)
+		}
+
+		// The contents are cut short, the file must not be read beyond them
+		nar = append(narTokens("nix-archive-1", "(", "type", "regular", "contents"), narLength(length)...)
+		nar = append(nar, "short"...)
+		if _, err := extract(t, nar); err == nil {
+			t.Errorf("contents length %d: Extract accepted a truncated NAR", length)
+		}
+		if _, err := narextract.List(bytes.NewReader(nar)); err == nil {
+			t.Errorf("contents length %d: List accepted a truncated NAR", length)
+		}
+	}
+}
+
+func TestExtractStopsAtMaxSize(t *testing.T) {
+	data := nar(narDirectory(
+		[]string{"a", "b"},
+		narRegular(strings.Repeat("a", 100), false),
+		narRegular(strings.Repeat("b", 1000), false),
+	))
+	listing, err := narextract.List(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The contents of b end one byte past the limit
+	b := listing.Entries["b"]
+	maxSize := b.NarOffset + b.Size - 1
+
+	dir := filepath.Join(t.TempDir(), "out")
+	ne, err := narextract.NewNarExtractor(bytes.NewReader(data), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ne.SetMaxSize(maxSize)
+	if err := ne.Extract(); !errors.Is(err, narextract.ErrNarTooLarge) {
+		t.Fatalf("got error %v, want %v", err, narextract.ErrNarTooLarge)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "a")); err != nil || len(data) != 100 {
+		t.Errorf("a has %d bytes: %v", len(data), err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "b")); !os.IsNotExist(err) {
+		t.Errorf("b was written past the limit: %v", err)
+	}
+	if ne.Offset() > maxSize {
+		t.Errorf("read up to offset %d, past the limit of %d", ne.Offset(), maxSize)
+	}
+}
+
+// modesNar has a file, an executable and a symlink in nested directories.
+var modesNar = nar(narDirectory(
+	[]string{"bin", "share"},
+	narDirectory([]string{"hello"}, narRegular("#!/bin/sh\n", true)),
+	narDirectory([]string{"doc", "link"},
+		narRegular("doc\n", false),
+		narSymlink("doc"),
+	),
+))
+
+// checkModes checks that the files extracted from modesNar to dir have the
+// canonical modes of a store path.
+func checkModes(t *testing.T, dir string) {
+	t.Helper()
+	for name, want := range map[string]os.FileMode{
+		".":          os.ModeDir | 0755,
+		"bin":        os.ModeDir | 0755,
+		"bin/hello":  0755,
+		"share":      os.ModeDir | 0755,
+		"share/doc":  0644,
+		"share/link": os.ModeSymlink,
+	} {
+		info, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := info.Mode()
+		if want == os.ModeSymlink {
+			got = got.Type()
+		}
+		if got != want {
+			t.Errorf("%s has mode %v, want %v", name, got, want)
+		}
+		if got&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky) != 0 {
+			t.Errorf("%s has mode %v", name, got)
+		}
+	}
+}
+
+func TestExtractModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on Windows")
+	}
+	dir, err := extract(t, modesNar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkModes(t, dir)
+}
@@ -0,0 +1,43 @@
+//go:build unix
+
+package narextract_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/simonfxr/nix-download/narextract"
+)
+
+func TestExtractIgnoresUmask(t *testing.T) {
+	old := syscall.Umask(077)
+	defer syscall.Umask(old)
+
+	dir, err := extract(t, modesNar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkModes(t, dir)
+
+	nf, err := narextract.NewNarFile(bytes.NewReader(modesNar), int64(len(modesNar)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	for name, want := range map[string]os.FileMode{"bin/hello": 0755, "share/doc": 0644} {
+		dest := filepath.Join(out, filepath.Base(name))
+		if err := nf.ExtractFile(name, dest); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Errorf("ExtractFile wrote %s with mode %v, want %v", name, info.Mode(), want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package narextract
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// NarFile provides random access to the members of a NAR stored in an
+// io.ReaderAt, such as a .nar file on disk.
+type NarFile struct {
+	r    io.ReaderAt
+	size int64
+	root *Entry
+}
+
+// NewNarFile returns a NarFile for the size bytes of NAR data in r. root is a
+// listing of the NAR, e.g. loaded from a .ls file; if it is nil the NAR is
+// scanned sequentially once to build it.
+func NewNarFile(r io.ReaderAt, size int64, root *Entry) (*NarFile, error) {
+	if root == nil {
+		var err error
+		root, err = List(bufio.NewReader(io.NewSectionReader(r, 0, size)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list NAR: %w", err)
+		}
+	}
+	return &NarFile{r: r, size: size, root: root}, nil
+}
+
+// Listing returns the listing of the NAR.
+func (nf *NarFile) Listing() *Entry {
+	return nf.root
+}
+
+// Lookup returns the entry for the slash separated path name relative to the
+// root of the NAR. An empty name refers to the root itself.
+func (nf *NarFile) Lookup(name string) (*Entry, error) {
+	entry := nf.root
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || component == "." {
+			continue
+		}
+		if entry.Type != "directory" {
+			return nil, fmt.Errorf("%s: not a directory", name)
+		}
+		child, ok := entry.Entries[component]
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+		}
+		entry = child
+	}
+	return entry, nil
+}
+
+// Open returns a reader for the contents of the regular file name.
+func (nf *NarFile) Open(name string) (*io.SectionReader, error) {
+	entry, err := nf.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Type != "regular" {
+		return nil, fmt.Errorf("%s: not a regular file", name)
+	}
+	if entry.NarOffset <= 0 || entry.Size < 0 || entry.NarOffset > nf.size-entry.Size {
+		return nil, fmt.Errorf("%s: contents out of bounds", name)
+	}
+	return io.NewSectionReader(nf.r, entry.NarOffset, entry.Size), nil
+}
+
+// ExtractFile writes the regular file or symlink name to dest, regular files
+// get mode 0644 or 0755. On Windows a symlink may be written as a file
+// containing its target, see createSymlink.
+func (nf *NarFile) ExtractFile(name, dest string) error {
+	entry, err := nf.Lookup(name)
+	if err != nil {
+		return err
+	}
+	switch entry.Type {
+	case "symlink":
+		_, err := createSymlink(entry.Target, dest)
+		return err
+	case "regular":
+	default:
+		return fmt.Errorf("%s: cannot extract %s", name, entry.Type)
+	}
+
+	contents, err := nf.Open(name)
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if entry.Executable {
+		mode = 0755
+	}
+	fd, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	// Like writeFile, the mode does not depend on the umask
+	if err := fd.Chmod(mode); err != nil {
+		return err
+	}
+	if _, err := io.Copy(fd, contents); err != nil {
+		return err
+	}
+	return fd.Close()
+}
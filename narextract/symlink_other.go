@@ -0,0 +1,18 @@
+//go:build !windows
+
+package narextract
+
+import "os"
+
+// createSymlink creates a symlink at path pointing to target. fallback
+// reports whether a placeholder file was written instead, which never
+// happens outside of Windows.
+func createSymlink(target, path string) (fallback bool, err error) {
+	return false, os.Symlink(target, path)
+}
+
+// isValidPlatformName reports whether name can be created as is on this
+// platform, isValidPathComponent has already checked it.
+func isValidPlatformName(name string) bool {
+	return true
+}
@@ -0,0 +1,30 @@
+//go:build windows
+
+package narextract
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// createSymlink creates a symlink at path pointing to target. Creating
+// symlinks needs a privilege or developer mode on Windows, without it a file
+// containing the target is written instead and fallback is true. The result
+// is not a usable store path but allows inspecting the NAR contents.
+func createSymlink(target, path string) (fallback bool, err error) {
+	if err := os.Symlink(filepath.FromSlash(target), path); err == nil {
+		return false, nil
+	}
+	if err := os.WriteFile(path, []byte(target), 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// isValidPlatformName reports whether name can be created as is on this
+// platform, isValidPathComponent has already checked it. Backslashes are path
+// separators and colons select alternate data streams on Windows.
+func isValidPlatformName(name string) bool {
+	return !strings.ContainsAny(name, `\:`)
+}
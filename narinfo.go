@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+)
+
+// narInfoJSON is the output of the narinfo command, the parsed narinfo of a
+// path along with where it was found and which key verified it.
+type narInfoJSON struct {
+	StorePath   string   `json:"storePath"`
+	Substituter string   `json:"substituter"`
+	URL         string   `json:"url"`
+	NarURL      string   `json:"narUrl"`
+	Compression string   `json:"compression"`
+	NarHash     string   `json:"narHash"`
+	NarSize     int64    `json:"narSize"`
+	FileHash    string   `json:"fileHash,omitempty"`
+	FileSize    int64    `json:"fileSize,omitempty"`
+	References  []string `json:"references"`
+	Deriver     string   `json:"deriver,omitempty"`
+	System      string   `json:"system,omitempty"`
+	CA          string   `json:"ca,omitempty"`
+	Sigs        []string `json:"sigs"`
+	// VerifiedBy is the name of the -public-key the first valid signature
+	// was made with, content-address for unsigned content-addressed paths or
+	// unsigned for paths from an -allow-unsigned-from substituter
+	VerifiedBy string `json:"verifiedBy"`
+}
+
+// printNarInfos fetches and verifies the narinfo of each of paths, base names,
+// and prints it as JSON, returning the exit status.
+func (d *Downloader) printNarInfos(paths []string) int {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	status := 0
+	for _, base := range paths {
+		sp, err := d.fetchNarInfo(base)
+		if err != nil {
+			log.Printf("Failed to fetch narinfo of %s/%s: %v", storeDir, base, err)
+			if status == 0 {
+				status = exitCode(err)
+			}
+			continue
+		}
+		info := narInfoJSON{
+			StorePath:   sp.NarInfo["StorePath"],
+			Substituter: sp.Substituter,
+			URL:         sp.NarInfo["URL"],
+			NarURL:      sp.NarURL,
+			Compression: sp.Compression,
+			NarHash:     sp.NarHash,
+			NarSize:     sp.NarSize,
+			FileHash:    sp.NarInfo["FileHash"],
+			FileSize:    sp.FileSize,
+			References:  sp.References,
+			Deriver:     sp.NarInfo["Deriver"],
+			System:      sp.NarInfo["System"],
+			CA:          sp.NarInfo["CA"],
+			Sigs:        sp.Sigs,
+		}
+		if info.References == nil {
+			info.References = []string{}
+		}
+		info.VerifiedBy = "unsigned"
+		if checkContentAddress(sp.NarInfo) == nil {
+			info.VerifiedBy = "content-address"
+		}
+		for _, sig := range sp.Sigs {
+			if d.verifySig(sp.NarInfo, sig) == nil {
+				info.VerifiedBy, _, _ = strings.Cut(sig, ":")
+				break
+			}
+		}
+		if err := enc.Encode(info); err != nil {
+			log.Fatalf("Failed to write narinfo: %v", err)
+		}
+	}
+	return status
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// narInfoIndex maps the hash part of store paths to the hex sha256 of their
+// narinfo, as read from the -narinfo-index file. Narinfos are only accepted
+// if they are listed with the same hash.
+var narInfoIndex map[string]string
+
+// loadNarInfoIndex reads the -narinfo-index file, consisting of lines with
+// the hash part of a store path and the hex sha256 of its narinfo separated
+// by whitespace. Empty lines and lines starting with # are ignored.
+func loadNarInfoIndex(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	narInfoIndex = make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) != 32 || len(fields[1]) != 2*sha256.Size {
+			return fmt.Errorf("line %d: expected <store path hash> <narinfo sha256>", i+1)
+		}
+		if _, err := hex.DecodeString(fields[1]); err != nil {
+			return fmt.Errorf("line %d: invalid sha256: %w", i+1, err)
+		}
+		narInfoIndex[fields[0]] = strings.ToLower(fields[1])
+	}
+	return nil
+}
+
+// checkNarInfoIndex checks the narinfo body fetched for hash against the
+// -narinfo-index, if given.
+func checkNarInfoIndex(hash string, body []byte) error {
+	if narInfoIndex == nil {
+		return nil
+	}
+	expected, ok := narInfoIndex[hash]
+	if !ok {
+		return fmt.Errorf("%w: narinfo of %s is not in the narinfo index", errNarInfoIndex, hash)
+	}
+	sum := sha256.Sum256(body)
+	if got := hex.EncodeToString(sum[:]); got != expected {
+		return fmt.Errorf("%w: narinfo of %s does not match the narinfo index: expected sha256 %s, got %s", errNarInfoIndex, hash, expected, got)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// perSubstituterJobs bounds the NAR downloads from each substituter running
+// at the same time, 0 for no limit besides -jobs
+var perSubstituterJobs = 0
+
+// narMirrors are the narinfos of the paths to download on the substituters
+// after the one discovery took them from, with the same NarHash. They are
+// only fetched with -per-substituter-jobs, so that paths can be downloaded
+// from another substituter than the first one having them.
+var narMirrors = struct {
+	sync.Mutex
+	paths map[string][]StorePath
+}{paths: map[string][]StorePath{}}
+
+// fetchNarMirrors fetches the narinfo of sp from each substituter after
+// sp.Substituter and records those with the same contents in narMirrors.
+func (d *Downloader) fetchNarMirrors(sp StorePath) {
+	i := slices.Index(d.Substituters, sp.Substituter)
+	if i < 0 {
+		return
+	}
+	var mirrors []StorePath
+	for _, substituter := range d.Substituters[i+1:] {
+		mirror, err := d.fetchNarInfoFrom(sp.BasePath, []string{substituter})
+		if err != nil || len(allowedCompressions) > 0 && !slices.Contains(allowedCompressions, mirror.Compression) {
+			continue
+		}
+		if mirror.NarHash != sp.NarHash {
+			logf(1, "%s has a different NarHash on %s, not downloading it from there", sp.BasePath, substituter)
+			continue
+		}
+		mirrors = append(mirrors, mirror)
+	}
+	if len(mirrors) > 0 {
+		narMirrors.Lock()
+		narMirrors.paths[sp.BasePath] = mirrors
+		narMirrors.Unlock()
+	}
+}
+
+// narSlots counts the NAR downloads running per substituter for
+// -per-substituter-jobs.
+var narSlots = struct {
+	sync.Mutex
+	cond  *sync.Cond
+	inUse map[string]int
+}{inUse: map[string]int{}}
+
+func init() {
+	narSlots.cond = sync.NewCond(&narSlots.Mutex)
+}
+
+// acquireNarSlot blocks until one of the substituters having sp runs fewer
+// than -per-substituter-jobs downloads and returns the narinfo of sp on it,
+// preferring the substituters in their order, and a function to release the
+// slot. It gives up with the error of ctx once ctx is done.
+func acquireNarSlot(ctx context.Context, sp StorePath) (StorePath, func(), error) {
+	if perSubstituterJobs == 0 {
+		return sp, func() {}, nil
+	}
+	narMirrors.Lock()
+	candidates := append([]StorePath{sp}, narMirrors.paths[sp.BasePath]...)
+	narMirrors.Unlock()
+
+	// Wake up the wait below when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		narSlots.Lock()
+		narSlots.cond.Broadcast()
+		narSlots.Unlock()
+	})
+	defer stop()
+
+	narSlots.Lock()
+	defer narSlots.Unlock()
+	for {
+		if err := ctx.Err(); err != nil {
+			return StorePath{}, nil, err
+		}
+		for _, c := range candidates {
+			if narSlots.inUse[c.Substituter] < perSubstituterJobs {
+				narSlots.inUse[c.Substituter]++
+				if c.Substituter != sp.Substituter {
+					logf(1, "Downloading %s from %s, %s is busy", sp.BasePath, c.Substituter, sp.Substituter)
+				}
+				return c, func() {
+					narSlots.Lock()
+					narSlots.inUse[c.Substituter]--
+					narSlots.Unlock()
+					narSlots.cond.Broadcast()
+				}, nil
+			}
+		}
+		narSlots.cond.Wait()
+	}
+}
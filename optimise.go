@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/simonfxr/nix-download/narextract"
+)
+
+// linksDir is the directory in the store holding one hard link per distinct
+// file, named like Nix's store optimisation does it. It is the index shared
+// by all paths extracted in this and previous runs.
+const linksDir = ".links"
+
+// optimisedBytes counts the bytes saved by -optimise in this run.
+var optimisedBytes atomic.Int64
+
+// optimisePath replaces the regular files of the path extracted to dir by
+// hard links to identical files in the store's .links directory, adding the
+// files not seen before. root is the listing of the extracted NAR.
+func (d *Downloader) optimisePath(dir string, root *narextract.Entry) error {
+	links := filepath.Join(d.NixStore, linksDir)
+	if err := os.MkdirAll(links, 0755); err != nil {
+		return err
+	}
+	return walkRegular(dir, root, func(path string, entry *narextract.Entry) error {
+		// Empty files are not worth a link
+		if entry.Size == 0 {
+			return nil
+		}
+		name, err := hashFileNar(path, entry.Executable)
+		if err != nil {
+			return err
+		}
+		return linkFile(path, filepath.Join(links, name), entry)
+	})
+}
+
+// walkRegular calls f for each regular file in the listing root extracted to
+// path. Listings can come from a substituter, so names that are not a single
+// path component fail the walk before anything outside path is accessed.
+func walkRegular(path string, root *narextract.Entry, f func(path string, entry *narextract.Entry) error) error {
+	switch root.Type {
+	case "regular":
+		return f(path, root)
+	case "directory":
+		for name, child := range root.Entries {
+			if !narextract.ValidEntryName(name) {
+				return fmt.Errorf("invalid file name %q in listing", name)
+			}
+			if err := walkRegular(filepath.Join(path, name), child, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// linkFile makes path a hard link to link, or creates link if it does not
+// exist yet.
+func linkFile(path, link string, entry *narextract.Entry) error {
+	err := os.Link(path, link)
+	if err == nil || !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	// The name covers the executable bit, but do not trust the contents of
+	// .links blindly
+	info, err := os.Stat(link)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Size() != entry.Size || (info.Mode()&0100 != 0) != entry.Executable {
+		return fmt.Errorf("%s does not match %s, not linking", link, path)
+	}
+
+	// Replace path atomically so that it never goes missing
+	tmp := path + ".nix-download-link"
+	if err := os.Link(link, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	optimisedBytes.Add(entry.Size)
+	return nil
+}
+
+// hashFileNar returns the nix base32 sha256 of the NAR serialisation of the
+// regular file at path, which is how Nix names the files in .links.
+func hashFileNar(path string, executable bool) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	writeNarString(h, "nix-archive-1")
+	writeNarString(h, "(")
+	writeNarString(h, "type")
+	writeNarString(h, "regular")
+	if executable {
+		writeNarString(h, "executable")
+		writeNarString(h, "")
+	}
+	writeNarString(h, "contents")
+	size := info.Size()
+	h.Write(binary.LittleEndian.AppendUint64(nil, uint64(size)))
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	h.Write(make([]byte, (8-size%8)%8))
+	writeNarString(h, ")")
+	return nixBase32Encode(h.Sum(nil)), nil
+}
+
+func writeNarString(w io.Writer, s string) {
+	w.Write(appendExportString(nil, s))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// planVersion is the version of the plan format written by -discover-only.
+const planVersion = 1
+
+// plan is the closure written by -discover-only and downloaded by
+// -from-plan. It holds the narinfos of the paths to download, which are
+// verified again when the plan is read, so that it can be edited or computed
+// on another machine.
+type plan struct {
+	Version  int        `json:"version"`
+	StoreDir string     `json:"storeDir"`
+	Paths    []planPath `json:"paths"`
+}
+
+// planPath is a path of a plan, in the order they are downloaded.
+type planPath struct {
+	Path        string            `json:"path"`
+	Substituter string            `json:"substituter"`
+	NarInfo     map[string]string `json:"narInfo"`
+	Sigs        []string          `json:"sigs"`
+}
+
+// writePlan writes the paths to download of cl as a plan to w.
+func writePlan(w io.Writer, cl closure) error {
+	p := plan{Version: planVersion, StoreDir: storeDir, Paths: []planPath{}}
+	for _, sp := range cl.StorePaths {
+		p.Paths = append(p.Paths, planPath{
+			Path:        storeDir + "/" + sp.BasePath,
+			Substituter: sp.Substituter,
+			NarInfo:     sp.NarInfo,
+			Sigs:        sp.Sigs,
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// loadPlan reads the plan in file and returns the closure of its paths not
+// yet present. The narinfos are checked like fetched ones.
+func (d *Downloader) loadPlan(file string) (closure, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return closure{}, err
+	}
+	var p plan
+	if err := json.Unmarshal(data, &p); err != nil {
+		return closure{}, fmt.Errorf("invalid plan: %w", err)
+	}
+	if p.Version != planVersion {
+		return closure{}, fmt.Errorf("unsupported plan version %d", p.Version)
+	}
+	if p.StoreDir != storeDir {
+		return closure{}, fmt.Errorf("plan is for store directory %s, not %s (see -store-dir)", p.StoreDir, storeDir)
+	}
+
+	var cl closure
+	for _, pp := range p.Paths {
+		base, err := parseStoreBase(pp.Path)
+		if err != nil {
+			return closure{}, fmt.Errorf("invalid plan: %w", err)
+		}
+		if d.isPresent(base) {
+			cl.Present = append(cl.Present, base)
+			continue
+		}
+		substituter, err := normalizeSubstituter(pp.Substituter)
+		if err != nil {
+			return closure{}, fmt.Errorf("invalid substituter for %s: %w", pp.Path, err)
+		}
+		// The NAR URL is resolved against the substituter, which must be
+		// trusted like the -substituter flags
+		if !slices.Contains(d.Substituters, substituter) {
+			return closure{}, fmt.Errorf("substituter %s of %s is not one of the -substituter URLs", substituter, pp.Path)
+		}
+		// The narinfos of a plan were not served by the substituter, so
+		// -allow-unsigned-from does not apply
+		sp, err := d.newStorePath(base, substituter, pp.NarInfo, pp.Sigs, false)
+		if err != nil {
+			return closure{}, fmt.Errorf("invalid narinfo for %s: %w", pp.Path, err)
+		}
+		if len(allowedCompressions) > 0 && !slices.Contains(allowedCompressions, sp.Compression) {
+			return closure{}, fmt.Errorf("compression %s of %s is not allowed (see -allow-compression)", sp.Compression, pp.Path)
+		}
+		cl.StorePaths = append(cl.StorePaths, sp)
+	}
+	cl.StorePaths = sortTopologically(cl.StorePaths)
+	return cl, nil
+}
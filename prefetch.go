@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// isURL reports whether a prefetch argument is a URL rather than a store
+// path.
+func isURL(arg string) bool {
+	return strings.Contains(arg, "://")
+}
+
+// prefetchPaths prints the hash of each of args, URLs or store path base
+// names, like nix-prefetch-url and returns the exit status.
+func (d *Downloader) prefetchPaths(args []string, opts *options) int {
+	status := 0
+	for _, arg := range args {
+		var hash []byte
+		var storePath string
+		var err error
+		if isURL(arg) {
+			hash, storePath, err = d.prefetchURL(arg, opts.name)
+		} else {
+			storePath = storeDir + "/" + arg
+			hash, err = d.prefetchStorePath(arg)
+		}
+		if err != nil {
+			log.Printf("Failed to prefetch %s: %v", arg, err)
+			if status == 0 {
+				status = exitCode(err)
+			}
+			continue
+		}
+		fmt.Printf("sha256-%s\n%s\n", base64.StdEncoding.EncodeToString(hash), nixBase32Encode(hash))
+		if opts.printPath {
+			fmt.Printf("%s\n", storePath)
+		}
+	}
+	return status
+}
+
+// prefetchStorePath downloads the NAR of the store path base to a temporary
+// file, verifies it and returns its hash.
+func (d *Downloader) prefetchStorePath(base string) ([]byte, error) {
+	sp, err := d.fetchNarInfo(base)
+	if err != nil {
+		return nil, err
+	}
+	f, err := d.fetchNarToFile(storeDir+"/"+base, sp)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return nixBase32Decode(strings.TrimPrefix(sp.NarHash, "sha256:"))
+}
+
+// prefetchURL downloads the file at u and returns its flat sha256 along with
+// the store path nix-prefetch-url adds it to, named name or after the last
+// component of the URL. The file is not kept.
+func (d *Downloader) prefetchURL(u, name string) ([]byte, string, error) {
+	if name == "" {
+		name = path.Base(strings.SplitN(u, "?", 2)[0])
+	}
+	// Check the name before downloading, the hash does not matter for it
+	if err := checkStorePathName(path.Base(fixedOutputPath(nil, name))); err != nil {
+		return nil, "", fmt.Errorf("invalid name, use -name: %w", err)
+	}
+
+	if offline && !isLocalURL(u) {
+		return nil, "", fmt.Errorf("offline: %s requires a network fetch", u)
+	}
+	resp, err := httpGet(d.NarClient, u)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &httpStatusError{"file", resp.Status}
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return nil, "", fmt.Errorf("failed to fetch: %w", err)
+	}
+	hash := h.Sum(nil)
+	return hash, fixedOutputPath(hash, name), nil
+}
+
+// fixedOutputPath returns the store path of the flat file with the given
+// sha256 named name, as computed by Nix for fixed-output derivations.
+func fixedOutputPath(hash []byte, name string) string {
+	inner := sha256.Sum256([]byte("fixed:out:sha256:" + hex.EncodeToString(hash) + ":"))
+	return makeStorePath("output:out", inner[:], name)
+}
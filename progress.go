@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// progressEvent is a single line written to the -progress-fd.
+type progressEvent struct {
+	Action     string `json:"action"`
+	Path       string `json:"path"`
+	BytesDone  int64  `json:"bytesDone,omitempty"`
+	BytesTotal int64  `json:"bytesTotal,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+var progress struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// emitProgress writes ev to the progress fd, if one was given.
+func emitProgress(ev progressEvent) {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	if progress.w == nil {
+		return
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	_, _ = progress.w.Write(append(data, '\n'))
+}
+
+// progressReader emits downloading events for the bytes read through it, at
+// most every progressInterval.
+type progressReader struct {
+	r     io.Reader
+	path  string
+	done  int64
+	total int64
+	last  time.Time
+}
+
+const progressInterval = 100 * time.Millisecond
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.done += int64(n)
+	if now := time.Now(); now.Sub(pr.last) >= progressInterval || (n > 0 && pr.done == pr.total) {
+		pr.last = now
+		emitProgress(progressEvent{Action: "downloading", Path: pr.path, BytesDone: pr.done, BytesTotal: pr.total})
+	}
+	return n, err
+}
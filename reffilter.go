@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// refFilter is a -ref-filter pattern matched against the name part of
+// references.
+type refFilter struct {
+	pattern string
+	exclude bool
+}
+
+// refFilters decide which references discovery follows, the roots are always
+// downloaded.
+var refFilters []refFilter
+
+// parseRefFilter parses a -ref-filter, a glob of names to follow or, with a
+// leading !, to skip.
+func parseRefFilter(s string) (refFilter, error) {
+	pattern, exclude := strings.CutPrefix(s, "!")
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return refFilter{}, fmt.Errorf("invalid pattern %q", s)
+	}
+	return refFilter{pattern: pattern, exclude: exclude}, nil
+}
+
+// followReference reports whether discovery follows the reference base. If
+// there are include patterns, its name must match one of them, and it must
+// not match any exclude pattern.
+func followReference(base string) bool {
+	if len(refFilters) == 0 {
+		return true
+	}
+	_, name, _ := strings.Cut(base, "-")
+	included, hasIncludes := false, false
+	for _, f := range refFilters {
+		matched, _ := path.Match(f.pattern, name)
+		if f.exclude {
+			if matched {
+				return false
+			}
+			continue
+		}
+		hasIncludes = true
+		included = included || matched
+	}
+	return included || !hasIncludes
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// parallelRoots is the number of root arguments processed at the same time
+// with -parallel-roots, each with its own discovery and download. 0 discovers
+// the closure of all roots in a single pass.
+var parallelRoots = 0
+
+// jobSlots bounds the NAR downloads of all roots processed at the same time
+// by -jobs. It is only set with -parallel-roots, a single pass is bounded by
+// its workers.
+var jobSlots chan struct{}
+
+// acquireJobSlot blocks until fewer than -jobs NARs are downloaded and
+// returns a function to release the slot. It gives up with the error of ctx
+// once ctx is done.
+func acquireJobSlot(ctx context.Context) (func(), error) {
+	if jobSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case jobSlots <- struct{}{}:
+		return func() { <-jobSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pathClaim is the download of a path by one of the roots processed at the
+// same time, err is its result once done is closed.
+type pathClaim struct {
+	done chan struct{}
+	err  error
+}
+
+// pathClaims are the paths downloaded by the roots processed at the same
+// time, so that a dependency they share is only downloaded once. Roots
+// started later find the path in the store.
+var pathClaims = struct {
+	sync.Mutex
+	paths map[string]*pathClaim
+}{paths: map[string]*pathClaim{}}
+
+// claimPath makes the caller download base unless another root already does.
+// If it does, wait returns once that download is done, with an error if it
+// failed. Otherwise wait is nil and the caller has to pass the result of its
+// download to finish.
+func claimPath(base string) (wait func(ctx context.Context) error, finish func(error)) {
+	if parallelRoots == 0 {
+		return nil, func(error) {}
+	}
+	pathClaims.Lock()
+	defer pathClaims.Unlock()
+	if claim, ok := pathClaims.paths[base]; ok {
+		return func(ctx context.Context) error {
+			select {
+			case <-claim.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if claim.err != nil {
+				return fmt.Errorf("failed for another root: %w", claim.err)
+			}
+			return nil
+		}, nil
+	}
+	claim := &pathClaim{done: make(chan struct{})}
+	pathClaims.paths[base] = claim
+	return nil, func(err error) {
+		claim.err = err
+		close(claim.done)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+)
+
+// state records the paths completed by this and earlier runs in the -state
+// file, so that a resumed run does not fetch their narinfos again.
+var state struct {
+	mu   sync.Mutex
+	file *os.File
+	done map[string]struct{}
+}
+
+// loadState reads the completed paths from name and opens it to record the
+// paths completed in this run. Entries whose path is no longer present are
+// dropped.
+func (d *Downloader) loadState(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	state.done = make(map[string]struct{})
+	var valid []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		base, err := parseStoreBase(line)
+		if err != nil {
+			return fmt.Errorf("invalid state entry: %w", err)
+		}
+		if !d.pathOnDisk(base) {
+			logf(1, "Ignoring %s/%s from the state file, it is no longer present", storeDir, base)
+			continue
+		}
+		state.done[base] = struct{}{}
+		valid = append(valid, storeDir+"/"+base)
+	}
+
+	if err := writePaths(name, valid); err != nil {
+		return err
+	}
+	state.file, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// inState reports whether storeBase was completed according to the state.
+func inState(storeBase string) bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	_, ok := state.done[storeBase]
+	return ok
+}
+
+// recordState appends storeBase to the state file, if one is used.
+func recordState(storeBase string) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.file == nil {
+		return nil
+	}
+	state.done[storeBase] = struct{}{}
+	_, err := fmt.Fprintf(state.file, "%s/%s\n", storeDir, storeBase)
+	return err
+}
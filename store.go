@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// daemonSocket is where a multi-user Nix installation's daemon listens.
+const daemonSocket = "/nix/var/nix/daemon-socket/socket"
+
+// checkStoreWritable makes sure paths can be created in the store, creating
+// the store if its nearest existing parent is writable, and prepares the
+// directory for temporary paths.
+func (d *Downloader) checkStoreWritable() error {
+	dir := d.NixStore
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	f, err := os.CreateTemp(dir, ".nix-download-probe-*")
+	if err == nil {
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			return err
+		}
+		if dir != d.NixStore {
+			if err := os.MkdirAll(d.NixStore, 0755); err != nil {
+				return err
+			}
+		}
+		return d.initTempDir()
+	}
+
+	msg := fmt.Sprintf("cannot write to %s (%v).\nRun as a user that can write to the store (e.g. with sudo) or use -store to download to another location", dir, err)
+	if _, statErr := os.Stat(daemonSocket); statErr == nil {
+		msg += fmt.Sprintf(".\nThe store seems to be managed by nix-daemon (%s exists), which only allows the daemon to add paths: use -use-daemon to import the paths with it", daemonSocket)
+	}
+	return errors.New(msg)
+}
+
+// tempDirName is the directory in the store paths are extracted to before
+// they are renamed into place. Keeping them out of the store root hides them
+// from tools listing the store and makes them easy to exclude and sweep.
+const tempDirName = ".nix-download-tmp"
+
+// tempDirLock is the open temporary directory, the lock on it is held until
+// the process exits.
+var tempDirLock *os.File
+
+// tempDir returns the temporary directory of the path base.
+func (d *Downloader) tempDir(base string) string {
+	return filepath.Join(d.NixStore, tempDirName, base)
+}
+
+// initTempDir creates the temporary directory of the store and locks it for
+// the run. Leftovers of interrupted runs are removed if no other run holds a
+// lock, i.e. uses the directory.
+func (d *Downloader) initTempDir() error {
+	dir := filepath.Join(d.NixStore, tempDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if !sameFilesystem(dir, d.NixStore) {
+		log.Printf("Warning: %s is on another filesystem than the store, paths are copied into place", dir)
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	tempDirLock = f
+	exclusive, err := lockTempDir(f)
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %w", dir, err)
+	}
+	if !exclusive {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		logf(1, "Removing leftover %s", filepath.Join(dir, entry.Name()))
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return shareTempDirLock(f)
+}
+
+// rename is os.Rename, tests replace it to make moveIntoPlace take the path of
+// a rename across filesystems.
+var rename = os.Rename
+
+// moveIntoPlace renames the extracted path tempDir to destPath. With bind
+// mounts or overlay setups the two can be on different filesystems, then the
+// path is copied next to destPath and renamed from there, so that destPath
+// still appears atomically.
+func moveIntoPlace(tempDir, destPath string) error {
+	err := rename(tempDir, destPath)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	logf(1, "Copying %s to %s on another filesystem", tempDir, destPath)
+	copyPath := filepath.Join(filepath.Dir(destPath), ".nix-download-copy_"+filepath.Base(destPath))
+	// Remove the leftovers of an interrupted copy
+	if err := os.RemoveAll(copyPath); err != nil {
+		return err
+	}
+	if err := copyTree(tempDir, copyPath); err != nil {
+		os.RemoveAll(copyPath)
+		return fmt.Errorf("failed to copy across filesystems: %w", err)
+	}
+	if err := os.Rename(copyPath, destPath); err != nil {
+		os.RemoveAll(copyPath)
+		return err
+	}
+	return os.RemoveAll(tempDir)
+}
+
+// replacePath replaces the existing path destPath by the extracted path
+// tempDir, e.g. a corrupt copy found by -paranoid. The old path is renamed
+// aside and only removed once the new one is in place, so destPath is only
+// missing between two renames and processes using the old files keep them
+// until they close them. If the new path cannot be moved into place, the old
+// one is restored.
+func replacePath(tempDir, destPath string) error {
+	oldPath := filepath.Join(filepath.Dir(destPath), ".nix-download-old_"+filepath.Base(destPath))
+	// Remove the leftovers of an interrupted replacement
+	if err := removeTree(oldPath); err != nil {
+		return err
+	}
+	if err := os.Rename(destPath, oldPath); err != nil {
+		return err
+	}
+	if err := moveIntoPlace(tempDir, destPath); err != nil {
+		if restoreErr := os.Rename(oldPath, destPath); restoreErr != nil {
+			log.Printf("Warning: failed to restore %s: %v", destPath, restoreErr)
+		}
+		return err
+	}
+	if err := removeTree(oldPath); err != nil {
+		log.Printf("Warning: failed to remove the replaced copy of %s: %v", destPath, err)
+	}
+	return nil
+}
+
+// removeTree removes path like os.RemoveAll, including read-only directories
+// such as those of paths registered by Nix, which are made writable first.
+func removeTree(path string) error {
+	err := os.RemoveAll(path)
+	if !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	filepath.WalkDir(path, func(p string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.IsDir() {
+			os.Chmod(p, 0755)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
+
+// checkEmptyDir returns an error unless dir is an existing empty directory.
+func checkEmptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 0 {
+		return fmt.Errorf("%s is not empty", dir)
+	}
+	return nil
+}
+
+// clearDir removes the contents of dir, keeping dir itself.
+func clearDir(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		os.RemoveAll(filepath.Join(dir, entry.Name()))
+	}
+}
+
+// copyTree copies the directory, regular file or symlink src to dst, keeping
+// the permissions of files and directories.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.IsDir():
+			if err := os.Mkdir(target, 0755); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case entry.Type().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		default:
+			return fmt.Errorf("%s: unsupported file type %s", path, entry.Type())
+		}
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	// Like the NAR extractor, make the mode independent of the umask
+	if err := out.Chmod(perm); err != nil {
+		return err
+	}
+	return out.Close()
+}
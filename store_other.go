@@ -0,0 +1,21 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockTempDir never reports an exclusive lock without flock, so leftovers of
+// interrupted runs are not removed automatically.
+func lockTempDir(f *os.File) (exclusive bool, err error) {
+	return false, nil
+}
+
+func shareTempDirLock(f *os.File) error {
+	return nil
+}
+
+// sameFilesystem assumes the paths to be on the same filesystem, a rename
+// across filesystems is handled by moveIntoPlace.
+func sameFilesystem(a, b string) bool {
+	return true
+}
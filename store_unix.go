@@ -0,0 +1,40 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockTempDir locks the temporary directory f and reports whether the lock
+// is exclusive, i.e. no other run uses the directory. An exclusive lock is
+// turned into a shared one with shareTempDirLock once the directory has been
+// swept.
+func lockTempDir(f *os.File) (exclusive bool, err error) {
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, err
+	}
+	return false, shareTempDirLock(f)
+}
+
+// shareTempDirLock takes a shared lock on f, which blocks while another run
+// sweeps the directory.
+func shareTempDirLock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+}
+
+// sameFilesystem reports whether the paths a and b are on the same
+// filesystem, so that renames between them are atomic.
+func sameFilesystem(a, b string) bool {
+	var sa, sb syscall.Stat_t
+	if syscall.Stat(a, &sa) != nil || syscall.Stat(b, &sb) != nil {
+		return true
+	}
+	return sa.Dev == sb.Dev
+}
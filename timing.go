@@ -0,0 +1,193 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// traceTiming collects where the time of the run is spent for -trace-timing
+var traceTiming = false
+
+// slowestPaths is the number of paths whose breakdown -trace-timing prints.
+const slowestPaths = 5
+
+// phase is a step of downloading a path measured by -trace-timing.
+type phase int
+
+const (
+	// phaseRequest lasts until the NAR starts streaming
+	phaseRequest phase = iota
+	// phaseRead is spent reading the compressed NAR from the network or a
+	// file
+	phaseRead
+	// phaseDecompress is spent decompressing, including the setup of the
+	// decompressor
+	phaseDecompress
+	// phaseHash is spent hashing, or handing the data to the hashing
+	// goroutine
+	phaseHash
+	// phaseExtract is spent writing the files
+	phaseExtract
+	phaseOptimise
+	phaseRename
+	phasePostExtract
+	// phaseWait is spent by the extraction waiting for decompressed data,
+	// it is not reported but subtracted from phaseExtract
+	phaseWait
+	numPhases
+)
+
+var phaseNames = [numPhases]string{"request", "read", "decompress", "hash", "extract", "optimise", "rename", "post-extract", "wait"}
+
+// pathTiming are the durations of the phases of a path in nanoseconds. The
+// phases are measured in the goroutines of the pipeline, so they are updated
+// concurrently.
+type pathTiming struct {
+	base   string
+	total  atomic.Int64
+	phases [numPhases]atomic.Int64
+}
+
+var timings struct {
+	mu        sync.Mutex
+	discovery time.Duration
+	paths     []*pathTiming
+}
+
+// newPathTiming returns the timing of base, or nil without -trace-timing.
+// All methods of pathTiming do nothing on nil.
+func newPathTiming(base string) *pathTiming {
+	if !traceTiming {
+		return nil
+	}
+	pt := &pathTiming{base: base}
+	timings.mu.Lock()
+	timings.paths = append(timings.paths, pt)
+	timings.mu.Unlock()
+	return pt
+}
+
+// finish records the time since start as the total of the path.
+func (pt *pathTiming) finish(start time.Time) {
+	if pt != nil {
+		pt.total.Store(int64(time.Since(start)))
+	}
+}
+
+// add adds the time since start to phase p.
+func (pt *pathTiming) add(p phase, start time.Time) {
+	if pt != nil {
+		pt.phases[p].Add(int64(time.Since(start)))
+	}
+}
+
+// reader returns r with the time spent in its Read calls added to phase p.
+func (pt *pathTiming) reader(p phase, r io.Reader) io.Reader {
+	if pt == nil {
+		return r
+	}
+	return &timedReader{r: r, d: &pt.phases[p]}
+}
+
+// writer returns w with the time spent in its Write calls added to phase p.
+func (pt *pathTiming) writer(p phase, w io.Writer) io.Writer {
+	if pt == nil {
+		return w
+	}
+	return &timedWriter{w: w, d: &pt.phases[p]}
+}
+
+// phase returns the duration of phase p, the nested phases are subtracted
+// from the ones containing them.
+func (pt *pathTiming) phase(p phase) time.Duration {
+	d := pt.phases[p].Load()
+	switch p {
+	case phaseDecompress:
+		d -= pt.phases[phaseRead].Load()
+	case phaseExtract:
+		d -= pt.phases[phaseWait].Load() + pt.phases[phaseHash].Load()
+	}
+	return time.Duration(max(d, 0))
+}
+
+type timedReader struct {
+	r io.Reader
+	d *atomic.Int64
+}
+
+func (tr *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := tr.r.Read(p)
+	tr.d.Add(int64(time.Since(start)))
+	return n, err
+}
+
+type timedWriter struct {
+	w io.Writer
+	d *atomic.Int64
+}
+
+func (tw *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := tw.w.Write(p)
+	tw.d.Add(int64(time.Since(start)))
+	return n, err
+}
+
+// printTimings logs the -trace-timing breakdown: the discovery, the phases
+// summed over all paths and the phases of the slowest paths.
+func printTimings() {
+	timings.mu.Lock()
+	defer timings.mu.Unlock()
+
+	log.Printf("Timing breakdown, phases are summed over paths processed concurrently:")
+	log.Printf("  %-12s %s", "discovery", roundDuration(timings.discovery))
+	var sums [numPhases]time.Duration
+	for _, pt := range timings.paths {
+		for p := range phaseWait {
+			sums[p] += pt.phase(p)
+		}
+	}
+	for p := range phaseWait {
+		log.Printf("  %-12s %s", phaseNames[p], roundDuration(sums[p]))
+	}
+
+	paths := slices.Clone(timings.paths)
+	slices.SortFunc(paths, func(a, b *pathTiming) int {
+		return cmp.Compare(b.total.Load(), a.total.Load())
+	})
+	if len(paths) > slowestPaths {
+		paths = paths[:slowestPaths]
+	}
+	if len(paths) > 0 {
+		log.Printf("Slowest paths:")
+	}
+	for _, pt := range paths {
+		line := fmt.Sprintf("  %s/%s %s", storeDir, pt.base, roundDuration(time.Duration(pt.total.Load())))
+		var parts []string
+		for p := range phaseWait {
+			if d := roundDuration(pt.phase(p)); d > 0 {
+				parts = append(parts, phaseNames[p]+" "+d.String())
+			}
+		}
+		if len(parts) > 0 {
+			line += ": " + strings.Join(parts, ", ")
+		}
+		log.Print(line)
+	}
+}
+
+// roundDuration rounds d to milliseconds, or to microseconds if it is short.
+func roundDuration(d time.Duration) time.Duration {
+	if d < 10*time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
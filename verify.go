@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// verifyPaths checks each of paths, base names, in the store against the
+// NarHash and NarSize of its narinfo and returns the exit status.
+func (d *Downloader) verifyPaths(paths []string) int {
+	status := 0
+	for _, base := range paths {
+		if err := d.verifyPath(base); err != nil {
+			log.Printf("Failed to verify %s/%s: %v", storeDir, base, err)
+			if status == 0 {
+				status = exitCode(err)
+			}
+			continue
+		}
+		if !quiet {
+			fmt.Printf("%s/%s\n", storeDir, base)
+		}
+	}
+	return status
+}
+
+func (d *Downloader) verifyPath(base string) error {
+	sp, err := d.fetchNarInfo(base)
+	if err != nil {
+		return err
+	}
+	return d.checkPathNar(sp)
+}
+
+// checkPathNar checks the path sp in the store against its NarSize and
+// NarHash.
+func (d *Downloader) checkPathNar(sp StorePath) error {
+	h := sha256.New()
+	counter := &countingWriter{}
+	w := io.MultiWriter(h, counter)
+	writeNarString(w, "nix-archive-1")
+	if err := writeNarNode(w, filepath.Join(d.NixStore, sp.BasePath)); err != nil {
+		return err
+	}
+	if counter.n != sp.NarSize {
+		return fmt.Errorf("%w: expected NAR size %d, got %d", errHashMismatch, sp.NarSize, counter.n)
+	}
+	computedHash := "sha256:" + nixBase32Encode(h.Sum(nil))
+	if computedHash != sp.NarHash {
+		return fmt.Errorf("%w: expected %s, got %s", errHashMismatch, sp.NarHash, computedHash)
+	}
+	logf(2, "Verified %s: %s", sp.BasePath, computedHash)
+	return nil
+}
+
+// corruptPaths are the base names of present paths that failed the
+// -paranoid check, they are replaced by the downloaded copy.
+var corruptPaths = map[string]struct{}{}
+
+// checkPresent reports whether present paths are checked by -paranoid, which
+// only applies to paths in the store.
+func checkPresent() bool {
+	return paranoid && downloadOnlyDir == "" && !useDaemon
+}
+
+// checkPresentPath is the -paranoid check of the present path base, whose
+// narinfo fetch returned sp and fetchErr. A path with a narinfo must match
+// it, otherwise it must at least not be an empty directory, which is what an
+// interrupted extraction leaves behind.
+func (d *Downloader) checkPresentPath(base string, sp StorePath, fetchErr error) error {
+	if fetchErr == nil {
+		return d.checkPathNar(sp)
+	}
+	logf(1, "Cannot check %s against its narinfo: %v", base, fetchErr)
+	entries, err := os.ReadDir(filepath.Join(d.NixStore, base))
+	if err == nil && len(entries) == 0 {
+		return errors.New("empty directory")
+	}
+	return nil
+}
+
+// writeNarNode writes the NAR serialisation of the file at path to w.
+func writeNarNode(w io.Writer, path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	writeNarString(w, "(")
+	writeNarString(w, "type")
+	switch {
+	case info.Mode().IsRegular():
+		writeNarString(w, "regular")
+		if info.Mode()&0100 != 0 {
+			writeNarString(w, "executable")
+			writeNarString(w, "")
+		}
+		writeNarString(w, "contents")
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		size := info.Size()
+		w.Write(binary.LittleEndian.AppendUint64(nil, uint64(size)))
+		n, err := io.Copy(w, io.LimitReader(f, size))
+		if err != nil {
+			return err
+		}
+		if n != size {
+			return fmt.Errorf("%s changed while reading it", path)
+		}
+		w.Write(make([]byte, (8-size%8)%8))
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		writeNarString(w, "symlink")
+		writeNarString(w, "target")
+		writeNarString(w, target)
+	case info.IsDir():
+		writeNarString(w, "directory")
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		// ReadDir sorts by name, which is the order of the NAR entries
+		for _, entry := range entries {
+			writeNarString(w, "entry")
+			writeNarString(w, "(")
+			writeNarString(w, "name")
+			writeNarString(w, entry.Name())
+			writeNarString(w, "node")
+			if err := writeNarNode(w, filepath.Join(path, entry.Name())); err != nil {
+				return err
+			}
+			writeNarString(w, ")")
+		}
+	default:
+		return fmt.Errorf("%s has unsupported file type %s", path, info.Mode().Type())
+	}
+	writeNarString(w, ")")
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is set at build time with -ldflags "-X main.version=...", otherwise
+// the module version from the build info is used.
+var version = ""
+
+// userAgent is sent with all HTTP requests.
+var userAgent = ""
+
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// printVersion prints the version, the VCS revision the binary was built from
+// and the Go version for -version.
+func printVersion() {
+	commit := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				commit = setting.Value
+			}
+		}
+	}
+	fmt.Printf("nix-download %s\ncommit: %s\ngo: %s\n", toolVersion(), commit, runtime.Version())
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdDicts are the -zstd-dict dictionaries by their ID.
+var zstdDicts = map[uint32][]byte{}
+
+// loadZstdDict adds the zstd dictionary in file to zstdDicts.
+func loadZstdDict(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	dict, err := zstd.InspectDictionary(data)
+	if err != nil {
+		return fmt.Errorf("%s is not a zstd dictionary: %w", file, err)
+	}
+	zstdDicts[dict.ID()] = data
+	return nil
+}
+
+// zstdDecoderOptions returns the options of the zstd decoder of br, failing
+// if its first frame needs a dictionary that was not given with -zstd-dict.
+// The decoder would only report an unknown dictionary otherwise.
+func zstdDecoderOptions(br *bufio.Reader) ([]zstd.DOption, error) {
+	// Peek fails for short streams, which the decoder rejects
+	header, _ := br.Peek(zstd.HeaderMaxSize)
+	var h zstd.Header
+	if err := h.Decode(header); err == nil && h.DictionaryID != 0 {
+		if _, ok := zstdDicts[h.DictionaryID]; !ok {
+			return nil, fmt.Errorf("NAR is compressed with zstd dictionary %d, which requires -zstd-dict", h.DictionaryID)
+		}
+	}
+	if len(zstdDicts) == 0 {
+		return nil, nil
+	}
+	dicts := make([][]byte, 0, len(zstdDicts))
+	for _, dict := range zstdDicts {
+		dicts = append(dicts, dict)
+	}
+	return []zstd.DOption{zstd.WithDecoderDicts(dicts...)}, nil
+}